@@ -1,23 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/md5"
-	"encoding/binary"
 	"encoding/json"
-	"errors"
 	"io"
 	"log"
 	"net/http"
-	"slices"
 	"sort"
 	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v4"
-	"github.com/maxsupermanhd/go-wz/packet"
-	"github.com/maxsupermanhd/go-wz/replay"
 	"github.com/maxsupermanhd/go-wz/wznet"
 )
 
@@ -111,64 +104,41 @@ func APIgetGraphData(_ http.ResponseWriter, r *http.Request) (int, any) {
 	avg := []float64{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 	avgw := float64(60)
 
-	var rpl *replay.Replay
-	replaycontent, err := getReplayFromStorage(r.Context(), gid)
+	ev, err := GetReplayEvents(r.Context(), gid)
 	if err != nil {
 		if err != errReplayNotFound {
 			return 500, err
 		}
-	} else {
-		rpl, err = replay.ReadReplay(bytes.NewBuffer(replaycontent))
-		if err != nil {
-			return 500, err
-		}
-		if rpl == nil {
-			return 500, errors.New("replay is nil")
-		}
+		ev = nil
 	}
-	rplPktIndex := 0
+	orderIndex := 0
+	researchIndex := 0
 
-	prevOrderFp := make([]int32, 32)
-
-	calcDroidCs := func(droids []uint32) byte {
-		slices.Sort(droids)
-		buf := bytes.NewBufferString("")
-		binary.Write(buf, binary.NativeEndian, droids)
-		return md5.Sum(buf.Bytes())[0]
-	}
+	tracker := newReplayOrderTracker()
 
 	for i, v := range frames {
-		if rpl != nil {
-			rplPktCount := make([]int, rpl.Settings.GameOptions.Game.MaxPlayers)
+		if ev != nil {
+			rplPktCount := make([]int, ev.MaxPlayers)
 			gt, ok := v["gameTime"].(float64)
 			if ok {
-			rplcountloop:
-				for ; rplPktIndex < len(rpl.Messages); rplPktIndex++ {
-					switch p := rpl.Messages[rplPktIndex].NetPacket.(type) {
-					case packet.PkGameGameTime:
-						if p.GameTime >= uint32(gt) {
-							break rplcountloop
-						}
-					case packet.PkGameDroidInfo:
-						if p.SecOrder == wznet.DSO_RETURN_TO_LOC {
-							continue
-						}
-						if p.Order == wznet.DORDER_NONE {
-							continue
-						}
-						pos := rpl.Settings.GameOptions.NetplayPlayers[p.Player].Position
-						currOrderFp := (p.CoordX ^ p.CoordY) + int32(calcDroidCs(p.Droids))
-						if prevOrderFp[pos] != currOrderFp {
-							rplPktCount[pos]++
-							prevOrderFp[pos] = currOrderFp
-						}
-					case packet.PkGameResearchStatus:
-						rplPktCount[rpl.Settings.GameOptions.NetplayPlayers[p.Player].Position]++
+				for ; orderIndex < len(ev.DroidOrders) && ev.DroidOrders[orderIndex].GameTime < int(gt); orderIndex++ {
+					o := ev.DroidOrders[orderIndex]
+					if wznet.DROID_SECONDARY_ORDER(o.SecOrder) == wznet.DSO_RETURN_TO_LOC {
+						continue
+					}
+					if wznet.DORDER(o.DroidOrder) == wznet.DORDER_NONE {
+						continue
 					}
+					if effective, _ := tracker.track(o); effective {
+						rplPktCount[ev.Positions[o.Player]]++
+					}
+				}
+				for ; researchIndex < len(ev.Research) && ev.Research[researchIndex].GameTime < int(gt); researchIndex++ {
+					rplPktCount[ev.Positions[ev.Research[researchIndex].Player]]++
 				}
 			}
 			v["replayPackets"] = rplPktCount
-			rplPktSum := make([]int, rpl.Settings.GameOptions.Game.MaxPlayers)
+			rplPktSum := make([]int, ev.MaxPlayers)
 			for i2 := i - 60; i2 != i; i2++ {
 				if i2 < 0 {
 					continue
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/maxsupermanhd/lac"
+	"github.com/warzone2100/autohoster-frontend/replaystore"
+)
+
+var (
+	configPath   = flag.String("config", "config.json", "Frontend config with databaseConnString and replayStorage")
+	fromDriver   = flag.String("from", "postgres", "Backend to move replays from (postgres, fs, s3)")
+	toDriver     = flag.String("to", "", "Backend to move replays to (postgres, fs, s3)")
+	deleteSource = flag.Bool("delete", false, "Delete replay from source once copy is verified")
+	fromGame     = flag.Int("fromGame", 0, "Only move games with id starting from this one")
+	limit        = flag.Int("limit", 0, "Stop after this many replays (0 moves everything)")
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Parse()
+	if *toDriver == "" || *toDriver == *fromDriver {
+		log.Fatal("-to must be set and differ from -from")
+	}
+	cfg, err := lac.FromFileJSON(*configPath)
+	must(err)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	db, err := pgxpool.Connect(ctx, cfg.GetDString("", "databaseConnString"))
+	must(err)
+	defer db.Close()
+	src, err := replaystore.Open(replaystore.LoadConfig(cfg, *fromDriver), db)
+	must(err)
+	dst, err := replaystore.Open(replaystore.LoadConfig(cfg, *toDriver), db)
+	must(err)
+
+	// replay_stored tells where replays that left games.replay column are
+	cond := `replay is not null`
+	args := []any{*fromGame}
+	if *fromDriver != "postgres" {
+		cond = `replay_stored = $2`
+		args = append(args, *fromDriver)
+	}
+	rows, err := db.Query(ctx, `select id from games where id >= $1 and `+cond+` order by id`, args...)
+	must(err)
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		must(rows.Scan(&id))
+		ids = append(ids, id)
+	}
+	must(rows.Err())
+	rows.Close()
+	log.Printf("Found %d replays in %s", len(ids), *fromDriver)
+
+	moved := 0
+	for _, id := range ids {
+		if ctx.Err() != nil || (*limit > 0 && moved >= *limit) {
+			break
+		}
+		err := moveReplay(ctx, src, dst, id, *deleteSource, func(ctx context.Context, id int) error {
+			return replaystore.MarkStored(ctx, db, id, *toDriver)
+		})
+		if err != nil {
+			log.Printf("Failed to move replay of game %d: %s", id, err.Error())
+			continue
+		}
+		moved++
+		if moved%100 == 0 {
+			log.Printf("Moved %d/%d replays", moved, len(ids))
+		}
+	}
+	log.Printf("Moved %d replays from %s to %s", moved, *fromDriver, *toDriver)
+}
+
+// moveReplay copies replay, verifies it and records new location with mark before source is deleted
+func moveReplay(ctx context.Context, src, dst replaystore.ReplayStore, id int, deleteSource bool, mark func(ctx context.Context, id int) error) error {
+	replay, err := src.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = dst.Put(ctx, id, replay)
+	if err != nil {
+		return err
+	}
+	check, err := dst.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(check, replay) {
+		return errors.New("replay read back from destination does not match")
+	}
+	err = mark(ctx, id)
+	if err != nil {
+		return err
+	}
+	if deleteSource {
+		return src.Delete(ctx, id)
+	}
+	return nil
+}
+
+func must(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/warzone2100/autohoster-frontend/replaystore"
+)
+
+func TestMoveReplay(t *testing.T) {
+	ctx := context.Background()
+	src, err := replaystore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := replaystore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := []byte("replay of game 5")
+	if err := src.Put(ctx, 5, replay); err != nil {
+		t.Fatal(err)
+	}
+
+	// source is kept when location can not be recorded
+	markErr := errors.New("database is down")
+	err = moveReplay(ctx, src, dst, 5, true, func(context.Context, int) error { return markErr })
+	if !errors.Is(err, markErr) {
+		t.Fatalf("got %v, want mark error", err)
+	}
+	if ok, _ := src.Exists(ctx, 5); !ok {
+		t.Fatal("source deleted before location was recorded")
+	}
+
+	marked := 0
+	err = moveReplay(ctx, src, dst, 5, true, func(_ context.Context, id int) error {
+		if ok, _ := src.Exists(ctx, id); !ok {
+			t.Error("source deleted before location was recorded")
+		}
+		marked = id
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marked != 5 {
+		t.Fatalf("marked game %d", marked)
+	}
+	if got, err := dst.Get(ctx, 5); err != nil || !bytes.Equal(got, replay) {
+		t.Fatalf("destination replay does not match: %v", err)
+	}
+	if _, err := src.Get(ctx, 5); !errors.Is(err, replaystore.ErrNotFound) {
+		t.Fatalf("source replay not deleted: %v", err)
+	}
+
+	if err := moveReplay(ctx, src, dst, 6, false, func(context.Context, int) error { return nil }); !errors.Is(err, replaystore.ErrNotFound) {
+		t.Fatalf("moving missing replay: %v", err)
+	}
+}
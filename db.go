@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 
+	"github.com/georgysavva/scany/dbscan"
 	"github.com/georgysavva/scany/pgxscan"
 )
 
@@ -22,6 +24,7 @@ type genericRequestParams struct {
 	searchSimilarity        float64
 	addWhereCase            string
 	columnsSpecifier        string
+	cursorKey               string // unique non-null column, enables cursor pagination
 }
 
 func genericViewRequest[T any](r *http.Request, params genericRequestParams) (int, any) {
@@ -104,7 +107,16 @@ func genericViewRequest[T any](r *http.Request, params genericRequestParams) (in
 		}
 	}
 
+	cursor, err := parsePageCursor(r, reqSortField, reqSortOrder)
+	if err != nil || (cursor != nil && params.cursorKey == "") {
+		return 400, errBadCursor
+	}
+	totalsMode := parseTotalsMode(r, cursor != nil)
+
 	ordercase := fmt.Sprintf("ORDER BY %s %s", reqSortField, reqSortOrder)
+	if params.cursorKey != "" && params.cursorKey != reqSortField {
+		ordercase += fmt.Sprintf(", %s %s", params.cursorKey, reqSortOrder)
+	}
 	limiter := fmt.Sprintf("LIMIT %d", reqLimit)
 	offset := fmt.Sprintf("OFFSET %d", reqOffset)
 
@@ -115,27 +127,98 @@ func genericViewRequest[T any](r *http.Request, params genericRequestParams) (in
 
 	tn := params.tableName
 
+	pagecase := wherecase
+	pageargs := append([]any{}, whereargs...)
+	if cursor != nil {
+		cond := keysetCondition(reqSortField, params.cursorKey, cursor, &pageargs)
+		if pagecase == "" {
+			pagecase = "WHERE " + cond
+		} else {
+			pagecase = "WHERE (" + pagecase[len("WHERE "):] + ") AND " + cond
+		}
+		offset = ""
+	}
+	if params.cursorKey != "" {
+		columnsSpecifier += ", " + reqSortField + "::text as cursor_sort, " + params.cursorKey + "::text as cursor_key"
+	}
+
 	var totalsNoFilter int
 	var totals int
 	var rows []*T
+	var next *pageCursor
 	// log.Println(`SELECT * FROM ` + tn + ` ` + wherecase + ` ` + ordercase + ` ` + offset + ` ` + limiter)
-	err := RequestMultiple(func() error {
-		return dbpool.QueryRow(r.Context(), `SELECT count(`+tn+`) FROM `+tn).Scan(&totalsNoFilter)
+	err = RequestMultiple(func() error {
+		var err error
+		totalsNoFilter, err = countRows(r.Context(), totalsMode, `SELECT 1 FROM `+tn)
+		return err
 	}, func() error {
-		return dbpool.QueryRow(r.Context(), `SELECT count(`+tn+`) FROM `+tn+` `+wherecase, whereargs...).Scan(&totals)
+		var err error
+		totals, err = countRows(r.Context(), totalsMode, `SELECT 1 FROM `+tn+` `+wherecase, whereargs...)
+		return err
 	}, func() error {
-		req := `SELECT ` + columnsSpecifier + ` FROM ` + tn + ` ` + wherecase + ` ` + ordercase + ` ` + offset + ` ` + limiter
+		req := `SELECT ` + columnsSpecifier + ` FROM ` + tn + ` ` + pagecase + ` ` + ordercase + ` ` + offset + ` ` + limiter
 		if cfg.GetDSBool(false, "displayQuery") {
-			log.Printf("req %s args %#+v", req, whereargs)
+			log.Printf("req %s args %#+v", req, pageargs)
+		}
+		if params.cursorKey == "" {
+			return pgxscan.Select(r.Context(), dbpool, &rows, req, pageargs...)
 		}
-		return pgxscan.Select(r.Context(), dbpool, &rows, req, whereargs...)
+		var err error
+		rows, next, err = selectWithCursor[T](r.Context(), req, pageargs...)
+		return err
 	})
 	if err != nil {
 		return 500, err
 	}
-	return 200, map[string]any{
-		"total":            totals,
-		"totalNotFiltered": totalsNoFilter,
-		"rows":             rows,
+	ret := map[string]any{
+		"rows": rows,
+	}
+	addTotals(ret, totalsMode, totals, totalsNoFilter)
+	if next != nil && len(rows) == reqLimit {
+		next.Sort = reqSortField
+		next.Order = reqSortOrder
+		ret["next"] = next.String()
+	}
+	return 200, ret
+}
+
+// cursorScanAPI ignores cursor columns that are not part of scanned struct
+var cursorScanAPI = func() *pgxscan.API {
+	dbscanAPI, err := pgxscan.NewDBScanAPI(dbscan.WithAllowUnknownColumns(true))
+	if err != nil {
+		panic(err)
+	}
+	api, err := pgxscan.NewAPI(dbscanAPI)
+	if err != nil {
+		panic(err)
+	}
+	return api
+}()
+
+// selectWithCursor scans rows of query that ends with cursor_sort and cursor_key columns,
+// returned cursor points to the last row and lacks sort and order
+func selectWithCursor[T any](ctx context.Context, query string, args ...any) ([]*T, *pageCursor, error) {
+	rows, err := dbpool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	rs := cursorScanAPI.NewRowScanner(rows)
+	ret := []*T{}
+	var last *pageCursor
+	for rows.Next() {
+		v := new(T)
+		err = rs.Scan(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		raw := rows.RawValues()
+		last = &pageCursor{Key: string(raw[len(raw)-1])}
+		if s := raw[len(raw)-2]; s != nil {
+			ss := string(s)
+			last.Value = &ss
+		}
+		ret = append(ret, v)
 	}
+	return ret, last, rows.Err()
 }
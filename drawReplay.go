@@ -16,48 +16,28 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v4"
-	"github.com/maxsupermanhd/go-wz/packet"
-	"github.com/maxsupermanhd/go-wz/replay"
 	"golang.org/x/image/draw"
 )
 
-func getReplayStuffs(ctx context.Context, gid int) (rpl *replay.Replay, mapimg image.Image, err error) {
-	log.Println("Getting replay from storage...")
-	replaycontent, err := getReplayFromStorage(ctx, gid)
-	if err != nil {
-		if err == errReplayNotFound {
-			return
-		}
-		return
-	}
-	log.Println("Loading replay...")
-	rpl, err = replay.ReadReplay(bytes.NewBuffer(replaycontent))
+func getReplayStuffs(ctx context.Context, gid int) (ev *ReplayEvents, mapimg image.Image, err error) {
+	ev, err = GetReplayEvents(ctx, gid)
 	if err != nil {
 		return
 	}
-	if rpl == nil {
-		return nil, nil, errors.New("replay is nil")
-	}
-	log.Println("Fetching map hash...")
 	maphash := ""
-	err = dbpool.QueryRow(context.Background(), `SELECT map_hash FROM games WHERE id = $1`, gid).Scan(&maphash)
+	err = dbpool.QueryRow(ctx, `SELECT map_hash FROM games WHERE id = $1`, gid).Scan(&maphash)
 	if err != nil {
 		return
 	}
-	log.Println("Fetching map image...")
 
 	slotcolors := make([]int, 10)
-	for _, v := range rpl.Settings.GameOptions.NetplayPlayers {
-		if v.Position >= 0 && v.Position <= 9 {
-			slotcolors[v.Position] = v.Colour
+	for i, pos := range ev.Positions {
+		if pos >= 0 && pos <= 9 {
+			slotcolors[pos] = ev.Colours[i]
 		}
 	}
 
 	mapimg, err = getMapPreviewWithColors(maphash, [10]int(slotcolors))
-	if err != nil {
-		return
-	}
-	log.Println("Replay stuffs prepared")
 	return
 }
 
@@ -87,7 +67,7 @@ func APIgetReplayHeatmap(w http.ResponseWriter, r *http.Request) (int, any) {
 		}
 	}
 
-	rpl, mapimg, err := getReplayStuffs(r.Context(), gid)
+	ev, mapimg, err := getReplayStuffs(r.Context(), gid)
 	if err != nil {
 		if err == errReplayNotFound {
 			return 204, nil
@@ -95,7 +75,7 @@ func APIgetReplayHeatmap(w http.ResponseWriter, r *http.Request) (int, any) {
 		return 500, err
 	}
 
-	img, err := genReplayHeatmap(*rpl, mapimg)
+	img, err := genReplayHeatmap(ev, mapimg)
 	if err != nil {
 		return 500, err
 	}
@@ -106,7 +86,7 @@ func APIgetReplayHeatmap(w http.ResponseWriter, r *http.Request) (int, any) {
 	return -1, nil
 }
 
-func genReplayHeatmap(rpl replay.Replay, mapimg image.Image) ([]byte, error) {
+func genReplayHeatmap(ev *ReplayEvents, mapimg image.Image) ([]byte, error) {
 	const scale = 16
 	const dotsize = 18
 
@@ -115,26 +95,23 @@ func genReplayHeatmap(rpl replay.Replay, mapimg image.Image) ([]byte, error) {
 	img := image.NewRGBA(image.Rectangle{Max: mapimg.Bounds().Max.Mul(mapimgscale)})
 	draw.NearestNeighbor.Scale(img, img.Rect, mapimg, mapimg.Bounds(), draw.Src, nil)
 
-	dots := make([]draw.Image, len(rpl.Settings.GameOptions.NetplayPlayers))
-	for i, v := range rpl.Settings.GameOptions.NetplayPlayers {
-		if v.Colour < 0 || v.Colour >= len(playerColors) {
-			log.Printf("Color overflow: %#v", v)
+	dots := make([]draw.Image, len(ev.Colours))
+	for i, c := range ev.Colours {
+		if c < 0 || c >= len(playerColors) {
+			log.Printf("Color overflow: player %d colour %d", i, c)
 		} else {
-			dots[i] = mkDot(dotsize, playerColors[v.Colour])
+			dots[i] = mkDot(dotsize, playerColors[c])
 		}
 	}
 	dotside := dots[0].Bounds().Max.X
 
-	for _, v := range rpl.Messages {
-		switch p := v.NetPacket.(type) {
-		case packet.PkGameDroidInfo:
-			if int(v.Player) > len(dots) {
-				continue
-			}
-			dot := dots[v.Player]
-			cx, cy := int((float64(p.CoordX)/128)*scale), int((float64(p.CoordY)/128)*scale)
-			draw.Draw(img, image.Rect(cx-dotside, cy-dotside, cx+dotside, cy+dotside), dot, image.Point{}, draw.Over)
+	for _, o := range ev.DroidOrders {
+		if o.Player >= len(dots) || dots[o.Player] == nil {
+			continue
 		}
+		dot := dots[o.Player]
+		cx, cy := int((float64(o.X)/128)*scale), int((float64(o.Y)/128)*scale)
+		draw.Draw(img, image.Rect(cx-dotside, cy-dotside, cx+dotside, cy+dotside), dot, image.Point{}, draw.Over)
 	}
 
 	ibuf := bytes.NewBuffer([]byte{})
@@ -168,7 +145,7 @@ func APIgetAnimatedReplayHeatmap(w http.ResponseWriter, r *http.Request) (int, a
 		return 400, nil
 	}
 
-	rpl, mapimg, err := getReplayStuffs(r.Context(), gid)
+	ev, mapimg, err := getReplayStuffs(r.Context(), gid)
 	if err != nil {
 		if err == errReplayNotFound {
 			return 204, nil
@@ -176,7 +153,7 @@ func APIgetAnimatedReplayHeatmap(w http.ResponseWriter, r *http.Request) (int, a
 		return 500, err
 	}
 
-	img, err := genReplayAnimatedHeatmap(r.Context(), *rpl, mapimg)
+	img, err := genReplayAnimatedHeatmap(r.Context(), ev, mapimg)
 	if err != nil {
 		return 500, err
 	}
@@ -187,7 +164,7 @@ func APIgetAnimatedReplayHeatmap(w http.ResponseWriter, r *http.Request) (int, a
 	return -1, nil
 }
 
-func genReplayAnimatedHeatmap(ctx context.Context, rpl replay.Replay, mapimg image.Image) ([]byte, error) {
+func genReplayAnimatedHeatmap(ctx context.Context, ev *ReplayEvents, mapimg image.Image) ([]byte, error) {
 	const scale = 8
 	const dotsize = 16
 	const step = 10000
@@ -201,8 +178,8 @@ func genReplayAnimatedHeatmap(ctx context.Context, rpl replay.Replay, mapimg ima
 
 	log.Println("Drawing dots...")
 	dots := []draw.Image{}
-	for _, v := range rpl.Settings.GameOptions.NetplayPlayers {
-		dots = append(dots, mkDot(dotsize, playerColors[v.Colour]))
+	for _, c := range ev.Colours {
+		dots = append(dots, mkDot(dotsize, playerColors[c]))
 	}
 	dotside := dots[0].Bounds().Max.X
 
@@ -210,34 +187,30 @@ func genReplayAnimatedHeatmap(ctx context.Context, rpl replay.Replay, mapimg ima
 
 	log.Println("Rendering frames...")
 	lastframeskip := 0
-	for start := 0; start < rpl.End.GameTimeElapsed; start += step {
+	for start := 0; start < ev.GameTimeElapsed; start += step {
 		frame := copyImage(smapimg)
-		nowgt := 0
 		collected := 0
 		i := 0
 		if errors.Is(ctx.Err(), context.Canceled) {
 			return nil, ctx.Err()
 		}
-	msgloop:
-		for i = lastframeskip; i < len(rpl.Messages); i++ {
-			switch p := rpl.Messages[i].NetPacket.(type) {
-			case packet.PkGameDroidInfo:
-				if nowgt < start {
-					continue msgloop
-				}
-				dot := dots[rpl.Messages[i].Player]
-				cx, cy := int((float64(p.CoordX)/128)*scale), int((float64(p.CoordY)/128)*scale)
-				draw.Draw(frame, image.Rect(cx-dotside, cy-dotside, cx+dotside, cy+dotside), dot, image.Point{}, draw.Over)
-				collected++
-			case packet.PkGameGameTime:
-				nowgt = int(p.GameTime)
-				if nowgt < start+step {
-					lastframeskip = i
-				}
-				if nowgt > start+duration {
-					break msgloop
-				}
+		nowgt := 0
+		for i = lastframeskip; i < len(ev.DroidOrders); i++ {
+			o := ev.DroidOrders[i]
+			nowgt = o.GameTime
+			if nowgt > start+duration {
+				break
+			}
+			if nowgt < start+step {
+				lastframeskip = i
+			}
+			if nowgt < start || o.Player >= len(dots) {
+				continue
 			}
+			dot := dots[o.Player]
+			cx, cy := int((float64(o.X)/128)*scale), int((float64(o.Y)/128)*scale)
+			draw.Draw(frame, image.Rect(cx-dotside, cy-dotside, cx+dotside, cy+dotside), dot, image.Point{}, draw.Over)
+			collected++
 		}
 		log.Printf("Frame %v collected %v skip %v gt %v i %v", start, collected, lastframeskip, GameTimeToStringI(nowgt), i)
 		g.Image = append(g.Image, frame)
@@ -1,35 +1,41 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
-	"fmt"
 	"log"
 	"math"
-	"net/http"
+	"slices"
+	"sync"
 	"sync/atomic"
 
-	"github.com/davecgh/go-spew/spew"
-	"github.com/jackc/pgx/v4"
+	"github.com/georgysavva/scany/pgxscan"
 )
 
 type Elo struct {
-	ID         int `json:"ID"`
-	Elo        int `json:"elo"`
-	Elo2       int `json:"elo2"`
-	Autowon    int `json:"autowon"`
-	Autolost   int `json:"autolost"`
-	Autoplayed int `json:"autoplayed"`
-	Userid     int `json:"userid"`
-	Timeplayed int `json:"timeplayed"`
+	Account    int
+	Elo        int
+	Mu         float64
+	Sigma      float64
+	Volatility float64
+	Played     int
+	Won        int
+	Lost       int
+	TimePlayed int
+	// unix time of last rated game and of last applied decay
+	LastPlayed  int
+	TimeDecayed int
 }
 
 type EloGamePlayer struct {
-	ID         int
-	Team       int
-	Usertype   string
-	EloDiff    int
-	RatingDiff int
+	Account        int
+	Position       int
+	Team           int
+	Usertype       string
+	TimeEliminated int
+	EloDiff        int
+	After          *Elo
 }
 
 type EloGame struct {
@@ -40,333 +46,278 @@ type EloGame struct {
 	Players     []EloGamePlayer
 	Timestarted int
 	Mod         string
+	Log         *RatingLog
 }
 
-func EloDiff(K, e1, e2 int) float64 {
-	return float64(K) * (1 / (1 + math.Pow(float64(10), float64(e1-e2)/float64(400))))
+func EloDiff(K float64, e1, e2 int) float64 {
+	return K * (1 / (1 + math.Pow(float64(10), float64(e1-e2)/float64(400))))
 }
 
-func CalcElo(G *EloGame, P map[int]*Elo) (calclog string) {
-	calclog += fmt.Sprintf("Processing game %d\n", G.ID)
+// CalcElo rates single game, G.Log holds calculation details or reason it was skipped
+func CalcElo(G *EloGame, P map[int]*Elo, rs RatingSystem) *RatingLog {
+	l := &RatingLog{Game: G.ID}
+	G.Log = l
 	if G.GameTime < 1000*60*2 {
-		calclog += "Game is too fast to be calculated\n"
-		return
+		l.Skipped = "Game is too fast to be calculated"
+		return l
 	}
 	if G.Mod == "masterbal" && G.Timestarted > 1666528200 {
-		calclog += "Game is played with draft balance\n"
-		return
+		l.Skipped = "Game is played with draft balance"
+		return l
 	}
 	if len(G.Players) == 1 {
-		calclog += "Only one player found, ignoring\n"
-		return
+		l.Skipped = "Only one player found"
+		return l
 	}
-	if len(G.Players) == 2 && G.Players[0].ID == G.Players[1].ID {
-		// P[G.Players[0].ID].Elo -= 40
-		// P[G.Players[0].ID].Autolost += 2
-		// G.Players[0].EloDiff = -20
-		// G.Players[1].EloDiff = -20
-		// if P[G.Players[0].ID].Userid != -1 && P[G.Players[0].ID].Userid != 0 {
-		// 	P[G.Players[0].ID].Elo2 -= 40
-		// }
-		calclog += "Duel with only one profile detected, bonk does not apply\n"
-		return
-	}
-	Team1ID := []int{}
-	Team2ID := []int{}
-	if !G.IsFFA {
-		for _, p := range G.Players {
-			if p.Team == 0 {
-				Team1ID = append(Team1ID, p.ID)
-			} else if p.Team == 1 {
-				Team2ID = append(Team2ID, p.ID)
-			}
-		}
-	} else {
-		fighterscount := 0
-		for _, p := range G.Players {
-			if p.Usertype == "winner" || p.Usertype == "loser" {
-				fighterscount++
-			}
-		}
-		if fighterscount == 2 {
-			Team1ID = append(Team1ID, G.Players[0].ID)
-			Team2ID = append(Team2ID, G.Players[1].ID)
-		} else {
-			calclog += "FFA game with not 2 players?!\n"
-			log.Printf("FFA game with not 2 players: %d", G.ID)
-			return
+	for _, p := range G.Players {
+		if p.Account <= 0 || P[p.Account] == nil {
+			l.Skipped = "Not all players have linked accounts"
+			return l
 		}
 	}
-	if len(Team1ID) != len(Team2ID) {
-		log.Printf("Incorrect length: %d", G.ID)
-		return
+	if len(G.Players) == 2 && G.Players[0].Account == G.Players[1].Account {
+		l.Skipped = "Duel with only one profile detected, bonk does not apply"
+		return l
 	}
-	for _, nid := range Team1ID {
-		for _, nnid := range Team2ID {
-			if nid == nnid {
-				calclog += "Game is sus, one player in both teams?!"
-				return
-			}
+	seen := map[int]bool{}
+	for _, p := range G.Players {
+		if seen[p.Account] {
+			l.Skipped = "Game is sus, one account plays in multiple slots"
+			return l
 		}
+		seen[p.Account] = true
 	}
-	Team1EloSum := 0
-	Team2EloSum := 0
-	for _, p := range Team1ID {
-		Team1EloSum += P[p].Elo
+	// in FFA every player is a team on its own
+	teamIndex := map[int]int{}
+	teamPlayers := [][]int{}
+	for pi, p := range G.Players {
+		key := p.Team
+		if G.IsFFA {
+			key = pi
+		}
+		ti, ok := teamIndex[key]
+		if !ok {
+			ti = len(teamPlayers)
+			teamIndex[key] = ti
+			teamPlayers = append(teamPlayers, []int{})
+		}
+		teamPlayers[ti] = append(teamPlayers[ti], pi)
 	}
-	for _, p := range Team2ID {
-		Team2EloSum += P[p].Elo
+	if len(teamPlayers) < 2 {
+		l.Skipped = "Only one team found"
+		return l
 	}
-	calclog += fmt.Sprintf("Elo sum: %d %d\n", Team1EloSum, Team2EloSum)
-	Team1Won := 0
-	Team2Won := 0
-	if G.Players[0].Usertype == "winner" {
-		SecondTeamFoundLost := false
-		for i, p := range G.Players {
-			if i == 0 {
-				continue
+	teamWon := make([]bool, len(teamPlayers))
+	teamEliminated := make([]int, len(teamPlayers))
+	winnersFound, losersFound := false, false
+	for ti, tp := range teamPlayers {
+		teamWon[ti] = G.Players[tp[0]].Usertype == "winner"
+		known := true
+		for _, pi := range tp {
+			p := G.Players[pi]
+			if (p.Usertype == "winner") != teamWon[ti] {
+				l.Skipped = "Game is sus, team has both winners and losers"
+				log.Printf("Game %d is sus", G.ID)
+				return l
 			}
-			if (p.Team != G.Players[0].Team || G.IsFFA) && p.Usertype == "loser" {
-				SecondTeamFoundLost = true
-				break
+			if p.TimeEliminated == 0 {
+				known = false
+			} else if p.TimeEliminated > teamEliminated[ti] {
+				teamEliminated[ti] = p.TimeEliminated
 			}
 		}
-		Team1Won = 1
-		if !SecondTeamFoundLost {
-			log.Printf("Game %d is sus", G.ID)
-			return
-		}
-	} else if G.Players[0].Usertype == "loser" {
-		SecondTeamFoundWon := false
-		for i, p := range G.Players {
-			if i == 0 {
-				continue
-			}
-			if (p.Team != G.Players[0].Team || G.IsFFA) && p.Usertype == "winner" {
-				SecondTeamFoundWon = true
-				break
-			}
+		if !known {
+			teamEliminated[ti] = 0
 		}
-		Team2Won = 1
-		if !SecondTeamFoundWon {
-			log.Printf("Game %d is sus", G.ID)
-			return
+		if teamWon[ti] {
+			winnersFound = true
+		} else {
+			losersFound = true
 		}
 	}
-	_ = Team1Won
-	_ = Team2Won
-	Team1EloAvg := Team1EloSum / len(Team1ID)
-	Team2EloAvg := Team2EloSum / len(Team2ID)
-	calclog += fmt.Sprintf("Elo avg: %d %d\n", Team1EloAvg, Team2EloAvg)
-	K := 20
-	diff1 := int(EloDiff(K, Team1EloAvg, Team2EloAvg))
-	diff2 := int(EloDiff(K, Team2EloAvg, Team1EloAvg))
-	calclog += fmt.Sprintf("Elo diff: %d %d\n", diff1, diff2)
-	var Additive int
-	var Timeitive int
-	if G.Players[0].Usertype == "winner" {
-		Additive = diff1
-		Timeitive = diff2
-	} else {
-		Additive = diff2
-		Timeitive = diff1
+	if !winnersFound || !losersFound {
+		l.Skipped = "Game is sus, no winners or no losers"
+		log.Printf("Game %d is sus", G.ID)
+		return l
 	}
-	calclog += fmt.Sprintf("Additive: %d\n", Additive)
-	calclog += fmt.Sprintf("Timeitive: %d\n", Timeitive)
-	calcelo2 := true
-	for _, p := range G.Players {
-		if P[p.ID].Userid == -1 || P[p.ID].Userid == 0 {
-			calcelo2 = false
-			break
+	ranks := eliminationRanks(teamWon, teamEliminated)
+	teams := make([][]*Elo, len(teamPlayers))
+	l.Teams = make([]RatingLogTeam, len(teamPlayers))
+	for ti, tp := range teamPlayers {
+		l.Teams[ti].Rank = ranks[ti]
+		for _, pi := range tp {
+			teams[ti] = append(teams[ti], P[G.Players[pi].Account])
+			l.Teams[ti].Accounts = append(l.Teams[ti].Accounts, G.Players[pi].Account)
 		}
 	}
-	calclog += fmt.Sprintf("Elo 2: %s\n", spew.Sprint(calcelo2))
-	var RAdditive int
-	var RTimeitive int
-	if calcelo2 {
-		Team1RatingSum := 0
-		Team2RatingSum := 0
-		for _, p := range Team1ID {
-			Team1RatingSum += P[p].Elo2
-		}
-		for _, p := range Team2ID {
-			Team2RatingSum += P[p].Elo2
-		}
-		calclog += fmt.Sprintf("Rating sum: %d %d\n", Team1RatingSum, Team2RatingSum)
-		Team1RatingAvg := Team1RatingSum / len(Team1ID)
-		Team2RatingAvg := Team2RatingSum / len(Team2ID)
-		calclog += fmt.Sprintf("Rating avg: %d %d\n", Team1RatingAvg, Team2RatingAvg)
-		rdiff1 := int(EloDiff(K, Team1RatingAvg, Team2RatingAvg))
-		rdiff2 := int(EloDiff(K, Team2RatingAvg, Team1RatingAvg))
-		calclog += fmt.Sprintf("Rating diff: %d %d\n", rdiff1, rdiff2)
-		if G.Players[0].Usertype == "winner" {
-			RAdditive = rdiff1
-			RTimeitive = rdiff2
-		} else {
-			RAdditive = rdiff2
-			RTimeitive = rdiff1
-		}
-		calclog += fmt.Sprintf("Rating additive: %d\n", RAdditive)
-		calclog += fmt.Sprintf("Rating timitive: %d\n", RTimeitive)
+	before := map[int]int{}
+	for _, p := range G.Players {
+		rs.Decay(P[p.Account], G.Timestarted)
+		before[p.Account] = P[p.Account].Elo
+	}
+	rs.Rate(teams, ranks, l)
+	if l.Skipped != "" {
+		return l
 	}
 	for pi, p := range G.Players {
-		calclog += fmt.Sprintf("Updating player %d (id %d)\n", pi, p.ID)
-		if calcelo2 {
-			P[p.ID].Autoplayed++
-			P[p.ID].Timeplayed += G.GameTime / 1000
-		}
+		e := P[p.Account]
+		e.Played++
+		e.TimePlayed += G.GameTime / 1000
+		e.LastPlayed = G.Timestarted
+		G.Players[pi].EloDiff = e.Elo - before[p.Account]
 		if p.Usertype == "winner" {
-			P[p.ID].Elo += Additive
-			G.Players[pi].EloDiff = Additive
-			if calcelo2 {
-				P[p.ID].Autowon++
-				P[p.ID].Elo2 += RAdditive
-				G.Players[pi].RatingDiff = RAdditive
-				calclog += fmt.Sprintf("Player %d won %d elo and %d rating\n", pi, Additive, RAdditive)
-			} else {
-				calclog += fmt.Sprintf("Player %d won %d elo\n", pi, Additive)
-			}
+			e.Won++
 		} else if p.Usertype == "loser" {
-			P[p.ID].Elo -= Additive
-			G.Players[pi].EloDiff = -Additive
-			// P[p.ID].Elo += int(math.Round((float64(Timeitive) / float64(60)) * (float64(G.GameTime) / (float64(90000) - 10))))
-			if calcelo2 {
-				P[p.ID].Autolost++
-				P[p.ID].Elo2 -= RAdditive
-				// P[p.ID].Elo2 += int(math.Round((float64(RTimeitive) / float64(60)) * (float64(G.GameTime) / (float64(90000) - 10))))
-				G.Players[pi].RatingDiff = -RAdditive
-				// G.Players[pi].EloDiff += int(math.Round((float64(RTimeitive) / float64(60)) * (float64(G.GameTime) / (float64(90000) - 10))))
-				calclog += fmt.Sprintf("Player %d lost %d elo and %d rating\n", pi, Additive, RAdditive)
-			} else {
-				// G.Players[pi].EloDiff += int(math.Round((float64(Timeitive) / float64(60)) * (float64(G.GameTime) / (float64(90000) - 10))))
-				calclog += fmt.Sprintf("Player %d lost %d elo\n", pi, Additive)
-			}
+			e.Lost++
 		}
+		after := *e
+		G.Players[pi].After = &after
+		l.Players = append(l.Players, RatingLogPlayer{
+			Account: p.Account,
+			Team:    p.Team,
+			Before:  before[p.Account],
+			After:   e.Elo,
+			Diff:    G.Players[pi].EloDiff,
+		})
 	}
-	return calclog
+	return l
 }
 
-func CalcEloForAll(G []*EloGame, P map[int]*Elo) (calclog string) {
+func CalcEloForAll(G []*EloGame, P map[int]*Elo, rs RatingSystem) {
 	for _, p := range P {
-		p.Elo = 1400
-		p.Elo2 = 1400
-		p.Autowon = 0
-		p.Autolost = 0
-		p.Autoplayed = 0
-		p.Timeplayed = 0
+		rs.Reset(p)
+		p.Won = 0
+		p.Lost = 0
+		p.Played = 0
+		p.TimePlayed = 0
+		p.LastPlayed = 0
+		p.TimeDecayed = 0
 	}
 	for gamei := range G {
-		calclog += CalcElo(G[gamei], P)
+		CalcElo(G[gamei], P, rs)
 	}
-	return calclog
 }
 
-var isEloRecalculating atomic.Bool
+// eliminationRanks places winners first, losers are ordered by
+// time they were eliminated, ones without known time share last place
+func eliminationRanks(won []bool, eliminated []int) []int {
+	times := []int{}
+	for i := range won {
+		if !won[i] && !slices.Contains(times, eliminated[i]) {
+			times = append(times, eliminated[i])
+		}
+	}
+	slices.Sort(times)
+	slices.Reverse(times)
+	ranks := make([]int, len(won))
+	for i := range won {
+		if !won[i] {
+			ranks[i] = 1 + slices.Index(times, eliminated[i])
+		}
+	}
+	return ranks
+}
+
+type eloStatsFrame struct {
+	GameTime float64 `json:"gameTime"`
+	Droids   []int   `json:"droids"`
+	Structs  []int   `json:"structs"`
+}
 
-func EloRecalcHandler(w http.ResponseWriter, _ *http.Request) {
-	if !isEloRecalculating.CompareAndSwap(false, true) {
-		w.Write([]byte("Already recalculating\n\n"))
-		return
+// eliminationTimes finds game time at which each slot lost all droids and
+// structures for good, graphs are stats frames recorded during the game
+func eliminationTimes(graphs []byte) map[int]int {
+	frames := []eloStatsFrame{}
+	ret := map[int]int{}
+	if json.Unmarshal(graphs, &frames) != nil {
+		return ret
 	}
-	rows, derr := dbpool.Query(context.Background(), `
-				SELECT
-					games.id as gid, gametime, alliancetype,
-					players, teams, usertype,
-					array_agg(to_json(p)::jsonb || json_build_object('userid', coalesce((SELECT id AS userid FROM accounts WHERE p.id = accounts.wzprofile2), -1))::jsonb)::text[] as pnames,
-					EXTRACT(EPOCH FROM timestarted)::int, mod
-				FROM games
-				JOIN players as p ON p.id = any(games.players)
-				WHERE deleted = false AND hidden = false AND calculated = true AND finished = true
-				GROUP BY gid
-				ORDER BY timestarted`)
-	if derr != nil {
-		if derr == pgx.ErrNoRows {
-			w.Write([]byte("No games\n\n"))
-		} else {
-			w.Write([]byte("Database query error: " + derr.Error() + "\n\n"))
+	slices.SortFunc(frames, func(a, b eloStatsFrame) int {
+		return cmp.Compare(a.GameTime, b.GameTime)
+	})
+	for _, f := range frames {
+		for pos := range f.Droids {
+			if pos >= len(f.Structs) {
+				break
+			}
+			if f.Droids[pos] == 0 && f.Structs[pos] == 0 {
+				if _, ok := ret[pos]; !ok {
+					ret[pos] = int(f.GameTime)
+				}
+			} else {
+				delete(ret, pos)
+			}
 		}
-		return
+	}
+	return ret
+}
+
+// eloGamesFrom selects rated games of category $1 starting from game $2, recalculation
+// progress counts games with the same predicate
+const eloGamesFrom = `from games as g
+join games_rating_categories as grc on grc.game = g.id
+join players as p on p.game = g.id
+join identities as i on i.id = p.identity
+where grc.category = $1 and g.id >= $2 and g.deleted = false and g.hidden = false and g.calculated = true
+	and g.game_time is not null and p.usertype = any('{winner,loser}')`
+
+// loadEloGames fetches finished games of rating category in order of calculation
+// starting with fromGame, limit of 0 fetches everything
+func loadEloGames(ctx context.Context, db pgxscan.Querier, category *RatingCategory, fromGame int, limit int) ([]*EloGame, map[int]*Elo, error) {
+	rows, err := db.Query(ctx, `select
+	g.id, g.game_time, g.setting_alliance, g.setting_base, extract(epoch from g.time_started)::int, g.mods,
+	array_agg(coalesce(i.account, -1) order by p.position),
+	array_agg(p.team order by p.position),
+	array_agg(p.usertype order by p.position),
+	array_agg(p.position order by p.position),
+	case when count(distinct p.team) > 2 or (g.setting_alliance = 0 and count(*) > 2) then g.graphs::text end
+`+eloGamesFrom+`
+group by g.id
+order by g.id
+limit nullif($3::int, 0)`, category.ID, fromGame, limit)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer rows.Close()
 	Games := []*EloGame{}
 	Players := map[int]*Elo{}
 	for rows.Next() {
 		var g EloGame
-		var players []int
-		var teams []int
-		var usertype []string
-		var playerinfo []string
 		var alliance int
-		err := rows.Scan(&g.ID, &g.GameTime, &alliance, &players, &teams, &usertype, &playerinfo, &g.Timestarted, &g.Mod)
+		var accounts []int
+		var teams []int
+		var usertypes []string
+		var positions []int
+		var graphs *string
+		err := rows.Scan(&g.ID, &g.GameTime, &alliance, &g.Base, &g.Timestarted, &g.Mod, &accounts, &teams, &usertypes, &positions, &graphs)
 		if err != nil {
-			w.Write([]byte("Database scan error: " + err.Error() + "\n\n"))
-			return
+			return nil, nil, err
 		}
 		g.IsFFA = alliance == 0
-		for _, pv := range playerinfo {
-			var e Elo
-			err := json.Unmarshal([]byte(pv), &e)
-			if err != nil {
-				w.Write([]byte("JSON error: " + err.Error() + "\n\n"))
-				return
-			}
-			Players[e.ID] = &e
+		// elimination order only matters when there are more than two sides
+		eliminated := map[int]int{}
+		if graphs != nil {
+			eliminated = eliminationTimes([]byte(*graphs))
 		}
-		for pslt, pid := range players {
-			if pid == -1 || pid == 370 {
-				continue
+		for pslt, acc := range accounts {
+			g.Players = append(g.Players, EloGamePlayer{
+				Account:        acc,
+				Position:       positions[pslt],
+				Team:           teams[pslt],
+				Usertype:       usertypes[pslt],
+				TimeEliminated: eliminated[positions[pslt]],
+			})
+			if _, ok := Players[acc]; !ok && acc > 0 {
+				Players[acc] = &Elo{Account: acc}
 			}
-			var p EloGamePlayer
-			p.Usertype = usertype[pslt]
-			p.ID = pid
-			p.Team = teams[pslt]
-			p.EloDiff = 0
-			p.RatingDiff = 0
-			g.Players = append(g.Players, p)
 		}
 		Games = append(Games, &g)
 	}
-	calclog := CalcEloForAll(Games, Players)
-	log.Println("Preparing batch update")
-	b := pgx.Batch{}
-	log.Printf("Generating %v player updates", len(Players))
-	for _, p := range Players {
-		b.Queue("UPDATE players SET elo = $1, elo2 = $2, autoplayed = $3, autowon = $4, autolost = $5, timeplayed = $6 WHERE id = $7",
-			p.Elo, p.Elo2, p.Autoplayed, p.Autowon, p.Autolost, p.Timeplayed, p.ID)
-	}
-	log.Printf("Generating %v game updates", len(Games))
-	for _, g := range Games {
-		var elodiffs []int
-		for _, p := range g.Players {
-			elodiffs = append(elodiffs, p.EloDiff)
-		}
-		var ratingdiffs []int
-		for _, p := range g.Players {
-			ratingdiffs = append(ratingdiffs, p.RatingDiff)
-		}
-		b.Queue("UPDATE games SET elodiff = $1, ratingdiff = $2 WHERE id = $3", elodiffs, ratingdiffs, g.ID)
-	}
-	log.Println("Resetting all residual values")
-	_, err := dbpool.Exec(context.Background(), "update games set ratingdiff = '{0, 0, 0, 0, 0, 0, 0, 0, 0, 0}', elodiff = '{0, 0, 0, 0, 0, 0, 0, 0, 0, 0}';")
-	if err != nil {
-		log.Println(err)
-	}
-	_, err = dbpool.Exec(context.Background(), "update players set autoplayed = 0, autowon = 0, autolost = 0, elo = 1400, elo2 = 1400;")
-	if err != nil {
-		log.Println(err)
-	}
-	log.Printf("Batch executing %v", b.Len())
-	br := dbpool.SendBatch(context.Background(), &b)
-	log.Printf("Batch executed, checking results")
-	for i := 0; i < b.Len(); i++ {
-		_, err := br.Exec()
-		if err != nil {
-			log.Println(err)
-			break
-		}
-	}
-	br.Close()
-	isEloRecalculating.Store(false)
-	log.Println("Elo recalc done")
-	w.Write([]byte(calclog))
+	return Games, Players, rows.Err()
 }
+
+var isEloRecalculating atomic.Bool
+
+// ratingWriteLock is held by recalculation, decay and season rollover,
+// each of them rewrites rating rows and would overwrite what the other one did
+var ratingWriteLock sync.Mutex
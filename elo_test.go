@@ -0,0 +1,144 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func testEloGame(players ...EloGamePlayer) *EloGame {
+	return &EloGame{ID: 1, GameTime: 10 * 60 * 1000, Timestarted: 1700000000, Mod: "master", Players: players}
+}
+
+func TestCalcEloSkipped(t *testing.T) {
+	winner := EloGamePlayer{Account: 1, Team: 0, Usertype: "winner"}
+	loser := EloGamePlayer{Account: 2, Team: 1, Usertype: "loser"}
+	for _, tc := range []struct {
+		game *EloGame
+		want string
+	}{
+		{&EloGame{GameTime: 60 * 1000, Players: []EloGamePlayer{winner, loser}}, "Game is too fast to be calculated"},
+		{&EloGame{GameTime: 600000, Mod: "masterbal", Timestarted: 1666528201, Players: []EloGamePlayer{winner, loser}}, "Game is played with draft balance"},
+		{testEloGame(winner), "Only one player found"},
+		{testEloGame(winner, EloGamePlayer{Account: -1, Team: 1, Usertype: "loser"}), "Not all players have linked accounts"},
+		{testEloGame(winner, EloGamePlayer{Account: 4, Team: 1, Usertype: "loser"}), "Not all players have linked accounts"},
+		{testEloGame(winner, EloGamePlayer{Account: 1, Team: 1, Usertype: "loser"}), "Duel with only one profile detected, bonk does not apply"},
+		{testEloGame(winner, loser, EloGamePlayer{Account: 2, Team: 0, Usertype: "winner"}), "Game is sus, one account plays in multiple slots"},
+		{testEloGame(winner, EloGamePlayer{Account: 2, Team: 0, Usertype: "winner"}), "Only one team found"},
+		{testEloGame(winner, loser, EloGamePlayer{Account: 3, Team: 1, Usertype: "winner"}), "Game is sus, team has both winners and losers"},
+		{testEloGame(EloGamePlayer{Account: 1, Team: 0, Usertype: "loser"}, loser), "Game is sus, no winners or no losers"},
+	} {
+		P := map[int]*Elo{1: {Account: 1, Elo: 1400}, 2: {Account: 2, Elo: 1400}, 3: {Account: 3, Elo: 1400}}
+		rs := newRatingSystemElo(RatingParams{})
+		l := CalcElo(tc.game, P, rs)
+		if l.Skipped != tc.want {
+			t.Errorf("got %q, want %q", l.Skipped, tc.want)
+		}
+		if tc.game.Log != l {
+			t.Errorf("log is not attached to game")
+		}
+		if P[1].Elo != 1400 || P[1].Played != 0 || P[2].Elo != 1400 || P[2].Played != 0 {
+			t.Errorf("%q changed ratings: %+v %+v", tc.want, P[1], P[2])
+		}
+	}
+}
+
+func TestCalcElo(t *testing.T) {
+	P := map[int]*Elo{1: {Account: 1}, 2: {Account: 2}}
+	rs := newRatingSystemElo(RatingParams{})
+	G := testEloGame(EloGamePlayer{Account: 1, Team: 0, Usertype: "winner"}, EloGamePlayer{Account: 2, Team: 1, Usertype: "loser"})
+	CalcEloForAll([]*EloGame{G}, P, rs)
+	if G.Log.Skipped != "" {
+		t.Fatal(G.Log.Skipped)
+	}
+	if P[1].Elo != 1410 || P[1].Won != 1 || P[1].Played != 1 || P[1].TimePlayed != 600 || P[1].LastPlayed != G.Timestarted {
+		t.Fatalf("winner %+v", P[1])
+	}
+	if P[2].Elo != 1390 || P[2].Lost != 1 {
+		t.Fatalf("loser %+v", P[2])
+	}
+	if G.Players[0].EloDiff != 10 || G.Players[1].EloDiff != -10 || G.Players[0].After.Elo != 1410 {
+		t.Fatalf("players %+v", G.Players)
+	}
+	if len(G.Log.Players) != 2 || G.Log.Players[1].Before != 1400 || G.Log.Players[1].After != 1390 {
+		t.Fatalf("log players %+v", G.Log.Players)
+	}
+}
+
+func TestEliminationRanks(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		won        []bool
+		eliminated []int
+		want       []int
+	}{
+		{"duel", []bool{true, false}, []int{0, 500}, []int{0, 1}},
+		{"last eliminated places higher", []bool{false, true, false, false}, []int{300, 0, 900, 600}, []int{3, 0, 1, 2}},
+		{"tie", []bool{true, false, false, false}, []int{0, 600, 600, 300}, []int{0, 1, 1, 2}},
+		{"unknown time shares last place", []bool{false, true, false, false}, []int{0, 0, 400, 0}, []int{2, 0, 1, 2}},
+		{"winners share first place", []bool{true, true, false}, []int{100, 0, 200}, []int{0, 0, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := eliminationRanks(tc.won, tc.eliminated)
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEliminationTimes(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		graphs string
+		want   map[int]int
+	}{
+		{"broken json", `{`, map[int]int{}},
+		{"frames out of order", `[
+			{"gameTime": 2000, "droids": [0, 4], "structs": [0, 9]},
+			{"gameTime": 1000, "droids": [3, 4], "structs": [1, 9]},
+			{"gameTime": 3000, "droids": [0, 4], "structs": [0, 9]}]`, map[int]int{0: 2000}},
+		{"revived slot", `[
+			{"gameTime": 1000, "droids": [0, 4], "structs": [0, 9]},
+			{"gameTime": 2000, "droids": [1, 4], "structs": [0, 9]},
+			{"gameTime": 3000, "droids": [0, 4], "structs": [0, 9]}]`, map[int]int{0: 3000}},
+		{"revived and survived", `[
+			{"gameTime": 1000, "droids": [0, 4], "structs": [0, 9]},
+			{"gameTime": 2000, "droids": [0, 4], "structs": [2, 9]}]`, map[int]int{}},
+		{"structs shorter than droids", `[
+			{"gameTime": 1000, "droids": [0, 0, 0], "structs": [0]}]`, map[int]int{0: 1000}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := eliminationTimes([]byte(tc.graphs))
+			if !maps.Equal(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCalcEloFFAPlacement(t *testing.T) {
+	P := map[int]*Elo{}
+	G := testEloGame()
+	G.IsFFA = true
+	// slot 2 survived longest among losers, slot 1 has no known elimination time
+	for i, el := range []int{600, 0, 900, 0} {
+		usertype := "loser"
+		if i == 3 {
+			usertype = "winner"
+		}
+		P[i+1] = &Elo{Account: i + 1}
+		G.Players = append(G.Players, EloGamePlayer{Account: i + 1, Team: 0, Usertype: usertype, TimeEliminated: el})
+	}
+	CalcEloForAll([]*EloGame{G}, P, newRatingSystemElo(RatingParams{}))
+	ranks := []int{}
+	for _, t := range G.Log.Teams {
+		ranks = append(ranks, t.Rank)
+	}
+	if !slices.Equal(ranks, []int{2, 3, 1, 0}) {
+		t.Fatalf("ranks %v", ranks)
+	}
+	if !(P[4].Elo > P[3].Elo && P[3].Elo > P[1].Elo && P[1].Elo > P[2].Elo) {
+		t.Fatalf("ratings do not follow placement: %d %d %d %d", P[1].Elo, P[2].Elo, P[3].Elo, P[4].Elo)
+	}
+}
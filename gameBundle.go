@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DataDog/zstd"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"github.com/warzone2100/autohoster-frontend/store"
+)
+
+type gameBundleFile struct {
+	Name    string
+	Content []byte
+}
+
+// gameBundleFiles collects everything known about the game, parts that are missing are left out
+func gameBundleFiles(r *http.Request, gid int) (*Game, []gameBundleFile, error) {
+	g, err := store.GetGame(r.Context(), dbpool, gid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if (g.Deleted || g.Hidden) && !isSuperadmin(r.Context(), sessionGetUsername(r)) {
+		return nil, nil, pgx.ErrNoRows
+	}
+	files := []gameBundleFile{}
+	gj, err := json.MarshalIndent(g, "", "\t")
+	if err != nil {
+		return nil, nil, err
+	}
+	files = append(files, gameBundleFile{"game.json", gj})
+
+	replayContent, err := getReplayFromStorage(r.Context(), gid)
+	if err == nil {
+		files = append(files, gameBundleFile{"autohoster-game-" + strconv.Itoa(gid) + ".wzrp", replayContent})
+	} else if err != errReplayNotFound {
+		return nil, nil, err
+	}
+
+	var researchLog, graphs []byte
+	err = dbpool.QueryRow(r.Context(), `select jsonb_pretty(research_log::jsonb), jsonb_pretty(graphs::jsonb) from games where id = $1`, gid).Scan(&researchLog, &graphs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(researchLog) > 0 {
+		files = append(files, gameBundleFile{"research.json", researchLog})
+	}
+	if len(graphs) > 0 {
+		files = append(files, gameBundleFile{"graphs.json", graphs})
+	}
+
+	slotColors := [10]int{}
+	for _, v := range g.Players {
+		if v.Position >= 0 && v.Position < len(slotColors) {
+			slotColors[v.Position] = v.Color
+		}
+	}
+	preview, err := getMapPreviewWithColors(g.MapHash, slotColors)
+	if err == nil {
+		buf := bytes.NewBuffer(nil)
+		err = png.Encode(buf, preview)
+		if err == nil {
+			files = append(files, gameBundleFile{"preview.png", buf.Bytes()})
+		}
+	}
+	if err != nil {
+		log.Printf("Bundle of game %d goes without map preview: %s", gid, err.Error())
+	}
+	return g, files, nil
+}
+
+func writeGameBundleZip(w io.Writer, modified time.Time, files []gameBundleFile) error {
+	z := zip.NewWriter(w)
+	for _, f := range files {
+		fw, err := z.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(f.Content)
+		if err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+func writeGameBundleTarZst(w io.Writer, modified time.Time, files []gameBundleFile) error {
+	zw := zstd.NewWriter(w)
+	t := tar.NewWriter(zw)
+	for _, f := range files {
+		err := t.WriteHeader(&tar.Header{Name: f.Name, Mode: 0644, Size: int64(len(f.Content)), ModTime: modified, Typeflag: tar.TypeReg})
+		if err != nil {
+			return err
+		}
+		_, err = t.Write(f.Content)
+		if err != nil {
+			return err
+		}
+	}
+	err := t.Close()
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func APIgetGameBundle(w http.ResponseWriter, r *http.Request) (int, any) {
+	gid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 400, nil
+	}
+	g, files, err := gameBundleFiles(r, gid)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 404, nil
+		}
+		return 500, err
+	}
+	name := "autohoster-game-" + strconv.Itoa(gid)
+	format := parseQueryStringFiltered(r, "format", "zip", "tar.zst")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"."+format+"\"")
+	if format == "tar.zst" {
+		w.Header().Set("Content-Type", "application/zstd")
+		err = writeGameBundleTarZst(w, g.TimeStarted, files)
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+		err = writeGameBundleZip(w, g.TimeStarted, files)
+	}
+	if err != nil {
+		log.Printf("Failed to stream bundle of game %d: %s", gid, err.Error())
+	}
+	return -1, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+type GameModerationLogEntry struct {
+	ID         int
+	Game       int
+	Action     string
+	Reason     string
+	Moderator  string
+	RecalcJobs []int
+	TimeDone   time.Time
+}
+
+// gameModerationActions maps action to column and value it sets
+var gameModerationActions = map[string]struct {
+	column string
+	value  bool
+}{
+	"hide":    {"hidden", true},
+	"unhide":  {"hidden", false},
+	"delete":  {"deleted", true},
+	"restore": {"deleted", false},
+	"exclude": {"calculated", false},
+	"include": {"calculated", true},
+}
+
+func GetGameModerationLog(ctx context.Context, gid int) ([]*GameModerationLogEntry, error) {
+	r := []*GameModerationLogEntry{}
+	return r, pgxscan.Select(ctx, dbpool, &r, `SELECT * FROM game_moderation_log WHERE game = $1 ORDER BY id DESC`, gid)
+}
+
+// queueGameRerate queues recalculation of every category game counts towards starting with it,
+// standings of archived categories are frozen and are left alone
+func queueGameRerate(ctx context.Context, tx pgx.Tx, gid int, username string) ([]int, error) {
+	categories := []int{}
+	err := pgxscan.Select(ctx, tx, &categories, `select grc.category from games_rating_categories as grc
+join rating_categories as c on c.id = grc.category
+where grc.game = $1 and c.archived = false
+order by grc.category`, gid)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []int{}
+	for _, c := range categories {
+		id, err := queueRatingRecalcTx(ctx, tx, c, gid, username)
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, id)
+	}
+	return jobs, nil
+}
+
+// modGameActionPOST hides, deletes, excludes from rating (and reverse) or re-rates the game,
+// flag changes of rated games re-rate it automatically
+func modGameActionPOST(w http.ResponseWriter, r *http.Request) {
+	if !checkFormParse(w, r) {
+		return
+	}
+	gid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Bad game id"})
+		return
+	}
+	action := r.FormValue("action")
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	username := sessionGetUsername(r)
+	var timeStarted time.Time
+	err = dbpool.QueryRow(r.Context(), `select time_started from games where id = $1`, gid).Scan(&timeStarted)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Game not found"})
+			return
+		}
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	// flag, recalculation jobs and audit record are committed together so no action goes unaudited
+	tx, err := dbpool.Begin(r.Context())
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	defer tx.Rollback(r.Context())
+	rerate := action == "rerate"
+	if !rerate {
+		a, ok := gameModerationActions[action]
+		if !ok {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Unknown action"})
+			return
+		}
+		tag, err := tx.Exec(r.Context(), `update games set `+a.column+` = $2 where id = $1 and `+a.column+` != $2`, gid, a.value)
+		if err != nil {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msg": "Nothing changed, game already has " + a.column + " set to " + strconv.FormatBool(a.value)})
+			return
+		}
+		rerate = true
+	}
+	jobs := []int{}
+	if rerate {
+		jobs, err = queueGameRerate(r.Context(), tx, gid, username)
+		if err != nil {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Failed to queue rating recalculation: " + err.Error()})
+			return
+		}
+	}
+	_, err = tx.Exec(r.Context(), `insert into game_moderation_log (game, action, reason, moderator, recalc_jobs) values ($1, $2, $3, $4, $5)`,
+		gid, action, reason, username, jobs)
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Failed to record moderation action: " + err.Error()})
+		return
+	}
+	err = tx.Commit(r.Context())
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	if len(jobs) > 0 {
+		ratingRecalcWake()
+	}
+	msg := fmt.Sprintf("Administrator `%s` did `%s` on game `%d`", username, action, gid)
+	if reason != "" {
+		msg += fmt.Sprintf(" (reason: %q)", reason)
+	}
+	if len(jobs) > 0 {
+		msg += fmt.Sprintf(", queued rating recalculation jobs %v", jobs)
+	}
+	err = modSendWebhook(msg)
+	if err != nil {
+		log.Println(err)
+	}
+	tid, _ := timeStarted.MarshalText()
+	w.Header().Set("Refresh", "1; /games/"+string(tid))
+	basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msggreen": true, "msg": "Done"})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"github.com/warzone2100/autohoster-frontend/store"
+)
+
+type RelatedGame struct {
+	ID          int
+	TimeStarted time.Time
+	MapName     string
+	Players     int
+	// Reasons are "rematch" (same players within a day), "players" and "map" (same map and player count)
+	Reasons []string
+}
+
+const relatedGamesLimit = 30
+
+// gameRoster identifies participants by account and falls back to identity
+// (negated to not collide) for players without one, spectators do not count
+func gameRoster(g *Game) []int {
+	roster := []int{}
+	for _, p := range g.Players {
+		if p.Usertype == "spectator" {
+			continue
+		}
+		if p.Account > 0 {
+			roster = append(roster, p.Account)
+		} else {
+			roster = append(roster, -p.Identity)
+		}
+	}
+	slices.Sort(roster)
+	return roster
+}
+
+// GetRelatedGames finds games with the same roster or the same map and player count,
+// closest in time first
+func GetRelatedGames(ctx context.Context, g *Game, includeHidden bool) ([]*RelatedGame, error) {
+	ret := []*RelatedGame{}
+	roster := gameRoster(g)
+	if len(roster) == 0 {
+		return ret, nil
+	}
+	visibility := ""
+	if !includeHidden {
+		visibility = "and g.deleted = false and g.hidden = false"
+	}
+	var (
+		id          int
+		timeStarted time.Time
+		mapName     string
+		players     int
+		samePlayers bool
+		sameMap     bool
+	)
+	// candidates are games of the first participant and games on the map close in time,
+	// only ones with the same number of players get their roster aggregated
+	_, err := dbpool.QueryFunc(ctx, `with candidates as (
+	select p.game from players as p
+	where p.identity = any(select id from identities where account = $6 or id = -$6)
+	union
+	(select g.id from games as g
+	where g.map_hash = $3 and g.time_started between $5::timestamp - make_interval(days => $7) and $5::timestamp + make_interval(days => $7)
+	order by abs(extract(epoch from g.time_started - $5))
+	limit $8)
+), sized as materialized (
+	select c.game from candidates as c
+	where c.game != $1 and (select count(*) from players as p where p.game = c.game and p.usertype != 'spectator') = $4::int
+)
+select g.id, g.time_started, g.map_name, $4::int, rr.roster = $2::int[], g.map_hash = $3
+from sized
+join games as g on g.id = sized.game
+cross join lateral (
+	select array_agg(coalesce(i.account, -i.id) order by coalesce(i.account, -i.id)) as roster
+	from players as p
+	join identities as i on i.id = p.identity
+	where p.game = g.id and p.usertype != 'spectator'
+) as rr
+where (rr.roster = $2::int[] or g.map_hash = $3) `+visibility+`
+order by rr.roster = $2::int[] desc, abs(extract(epoch from g.time_started - $5))
+limit `+strconv.Itoa(relatedGamesLimit),
+		[]any{g.ID, roster, g.MapHash, len(roster), g.TimeStarted, roster[0], cfg.GetDInt(30, "relatedGamesMapDays"), relatedGamesLimit * 10},
+		[]any{&id, &timeStarted, &mapName, &players, &samePlayers, &sameMap},
+		func(_ pgx.QueryFuncRow) error {
+			rg := &RelatedGame{ID: id, TimeStarted: timeStarted, MapName: mapName, Players: players, Reasons: []string{}}
+			if samePlayers {
+				d := rg.TimeStarted.Sub(g.TimeStarted)
+				if d < 24*time.Hour && d > -24*time.Hour {
+					rg.Reasons = append(rg.Reasons, "rematch")
+				} else {
+					rg.Reasons = append(rg.Reasons, "players")
+				}
+			}
+			if sameMap {
+				rg.Reasons = append(rg.Reasons, "map")
+			}
+			ret = append(ret, rg)
+			return nil
+		})
+	return ret, err
+}
+
+func APIgetRelatedGames(_ http.ResponseWriter, r *http.Request) (int, any) {
+	gid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 400, nil
+	}
+	g, err := store.GetGame(r.Context(), dbpool, gid)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 404, nil
+		}
+		return 500, err
+	}
+	isModerator := isSuperadmin(r.Context(), sessionGetUsername(r))
+	if (g.Deleted || g.Hidden) && !isModerator {
+		return 404, nil
+	}
+	related, err := GetRelatedGames(r.Context(), g, isModerator)
+	if err != nil {
+		return 500, err
+	}
+	return 200, related
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+type GameTag struct {
+	Game        int
+	Tag         string
+	Note        string
+	Account     int
+	DisplayName string
+	Locked      bool
+	TimeAdded   time.Time
+}
+
+var gameTagRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9 _-]{0,31}$`)
+
+const gameTagNoteMaxLength = 300
+
+func GetGameTags(ctx context.Context, gid int) ([]*GameTag, error) {
+	r := []*GameTag{}
+	return r, pgxscan.Select(ctx, dbpool, &r, `select t.game, t.tag, t.note, t.account, coalesce(a.display_name, a.username) as display_name, t.locked, t.time_added
+from game_tags as t
+join accounts as a on a.id = t.account
+where t.game = $1
+order by t.time_added`, gid)
+}
+
+// canTagGames checks if user can add tags, gameTagsAllowed config key is "users" or "moderators"
+func canTagGames(r *http.Request) bool {
+	if !checkUserAuthorized(r) {
+		return false
+	}
+	if cfg.GetDSString("users", "gameTagsAllowed") == "moderators" {
+		return isSuperadmin(r.Context(), sessionGetUsername(r))
+	}
+	return true
+}
+
+func APIgetGameTags(_ http.ResponseWriter, r *http.Request) (int, any) {
+	gid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 400, nil
+	}
+	tags, err := GetGameTags(r.Context(), gid)
+	if err != nil {
+		return 500, err
+	}
+	return 200, tags
+}
+
+// gameTagsPOST adds, removes, locks and unlocks tags of the game,
+// users can only change their own unlocked tags, moderators can change anything
+func gameTagsPOST(w http.ResponseWriter, r *http.Request) {
+	if !canTagGames(r) {
+		basicLayoutLookupRespond("noauth", w, r, map[string]any{})
+		return
+	}
+	if !checkFormParse(w, r) {
+		return
+	}
+	gid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Bad game id"})
+		return
+	}
+	var timeStarted time.Time
+	err = dbpool.QueryRow(r.Context(), `select time_started from games where id = $1`, gid).Scan(&timeStarted)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Game not found"})
+			return
+		}
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	tag := strings.ToLower(strings.TrimSpace(r.FormValue("tag")))
+	if !gameTagRegexp.MatchString(tag) {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Tag must be 1 to 32 lowercase letters, digits, spaces, dashes or underscores"})
+		return
+	}
+	note := strings.TrimSpace(r.FormValue("note"))
+	if len(note) > gameTagNoteMaxLength {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": fmt.Sprintf("Note is too long (max %d characters)", gameTagNoteMaxLength)})
+		return
+	}
+	username := sessionGetUsername(r)
+	isModerator := isSuperadmin(r.Context(), username)
+	account := sessionGetUserID(r)
+
+	var existingAccount int
+	var existingLocked bool
+	err = dbpool.QueryRow(r.Context(), `select account, locked from game_tags where game = $1 and tag = $2`, gid, tag).Scan(&existingAccount, &existingLocked)
+	exists := err == nil
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	if exists && !isModerator && (existingLocked || existingAccount != account) {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "This tag is locked or was added by someone else"})
+		return
+	}
+
+	action := r.FormValue("action")
+	var msg string
+	affected := int64(1)
+	switch action {
+	case "add":
+		_, err = dbpool.Exec(r.Context(), `insert into game_tags (game, tag, note, account) values ($1, $2, $3, $4)
+on conflict (game, tag) do update set note = excluded.note`, gid, tag, note, account)
+		msg = fmt.Sprintf("User `%s` tagged game `%d` with `%s`", username, gid, tag)
+		if note != "" {
+			msg += fmt.Sprintf(": %q", note)
+		}
+	case "remove":
+		ct, derr := dbpool.Exec(r.Context(), `delete from game_tags where game = $1 and tag = $2`, gid, tag)
+		affected, err = ct.RowsAffected(), derr
+		msg = fmt.Sprintf("User `%s` removed tag `%s` from game `%d`", username, tag, gid)
+	case "lock", "unlock":
+		if !isModerator {
+			basicLayoutLookupRespond("noauth", w, r, map[string]any{})
+			return
+		}
+		ct, derr := dbpool.Exec(r.Context(), `update game_tags set locked = $3 where game = $1 and tag = $2`, gid, tag, action == "lock")
+		affected, err = ct.RowsAffected(), derr
+		msg = fmt.Sprintf("Administrator `%s` %sed tag `%s` of game `%d`", username, action, tag, gid)
+	default:
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Unknown action"})
+		return
+	}
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	if affected == 0 {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Tag not found"})
+		return
+	}
+	err = modSendWebhook(msg)
+	if err != nil {
+		log.Println(err)
+	}
+	tid, _ := timeStarted.MarshalText()
+	w.Header().Set("Refresh", "1; /games/"+string(tid))
+	basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msggreen": true, "msg": "Tags updated"})
+}
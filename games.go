@@ -3,68 +3,24 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"html/template"
 	"image/png"
 	"log"
 	"net/http"
 	"regexp"
-	"slices"
 	_ "sort"
 	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v4"
+	"github.com/warzone2100/autohoster-frontend/store"
 )
 
-type PlayerRating struct {
-	Elo        int
-	Played     int
-	Won        int
-	Lost       int
-	TimePlayed int
-	Account    int
-	Category   int
-}
-
-type Player struct {
-	Position       int
-	Name           string
-	Team           int
-	Color          int
-	Identity       int
-	IdentityPubKey string
-	Usertype       string
-	Rating         *PlayerRating
-	Account        int
-	DisplayName    string
-	Props          map[string]any
-}
-
-type Game struct {
-	ID              int
-	Version         string
-	Instance        int
-	TimeStarted     time.Time
-	TimeEnded       *time.Time
-	GameTime        *int
-	SettingScavs    int
-	SettingAlliance int
-	SettingPower    int
-	SettingBase     int
-	MapName         string
-	MapHash         string
-	Mods            string
-	Deleted         bool
-	Hidden          bool
-	Calculated      bool
-	DebugTriggered  bool
-	Players         []Player
-	ReplayFound     bool
-	DisplayCategory int
-}
+type PlayerRating = store.PlayerRating
+type Player = store.Player
+type Game = store.Game
 
 func DbGameDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	requestedIdentifier := mux.Vars(r)["id"]
@@ -86,46 +42,11 @@ func DbGameDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Invalid id: " + err.Error()})
 		return
 	}
-	req := `select
-	g.id, g.version, g.instance, g.time_started, g.time_ended, g.game_time,
-	g.setting_scavs, g.setting_alliance, g.setting_power, g.setting_base,
-	g.map_name, g.map_hash, g.mods, g.deleted, g.hidden, g.calculated, g.debug_triggered,
-	g.display_category,
-	jsonb_pretty(json_agg(json_build_object(
-		'Position', p.position,
-		'Name', i.name,
-		'Team', p.team,
-		'Usertype', p.usertype,
-		'Color', p.color,
-		'Identity', i.id,
-		'IdentityPubKey', encode(i.pkey, 'hex'),
-		'Account', a.id,
-		'DisplayName', coalesce(i.name, a.display_name),
-		'Rating', (select r from rating as r where r.category = g.display_category and r.account = i.account),
-		'Props', p.props
-	))::jsonb) as players
-from games as g
-join players as p on p.game = g.id
-join identities as i on i.id = p.identity
-left join accounts as a on a.id = i.account
-where g.time_started = $1
-group by g.id`
-	g := Game{}
-	g.Players = []Player{}
-	playersJSON := ""
-	err = dbpool.QueryRow(r.Context(), req, tid).Scan(&g.ID, &g.Version, &g.Instance, &g.TimeStarted, &g.TimeEnded, &g.GameTime,
-		&g.SettingScavs, &g.SettingAlliance, &g.SettingPower, &g.SettingBase,
-		&g.MapName, &g.MapHash, &g.Mods, &g.Deleted, &g.Hidden, &g.Calculated, &g.DebugTriggered, &g.DisplayCategory,
-		&playersJSON)
+	g, err := store.GetGameStartedAt(r.Context(), dbpool, tid)
 	if err != nil {
 		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
 		return
 	}
-	err = json.Unmarshal([]byte(playersJSON), &g.Players)
-	if err != nil {
-		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Json unmarshal error: " + err.Error()})
-		return
-	}
 	g.ReplayFound = checkReplayExistsInStorage(r.Context(), g.ID)
 	// slices.SortFunc(gmsStage[0].Players, func(a Player, b Player) int {
 	// 	return a.Position - b.Position
@@ -148,7 +69,47 @@ group by g.id`
 		return
 	}
 
-	basicLayoutLookupRespond("gamedetails2", w, r, map[string]any{"Game": g, "Preview": base64.RawStdEncoding.EncodeToString(previewImageBuf.Bytes())})
+	ratingLogs, err := GetGameRatingLogs(r.Context(), g.ID)
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	accountNames := map[int]string{}
+	for _, p := range g.Players {
+		accountNames[p.Account] = p.DisplayName
+	}
+	tags, err := GetGameTags(r.Context(), g.ID)
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	isModerator := isSuperadmin(r.Context(), sessionGetUsername(r))
+	var moderationLog []*GameModerationLogEntry
+	if isModerator {
+		moderationLog, err = GetGameModerationLog(r.Context(), g.ID)
+		if err != nil {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+			return
+		}
+	}
+	related, err := GetRelatedGames(r.Context(), g, isModerator)
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+
+	basicLayoutLookupRespond("gamedetails2", w, r, map[string]any{
+		"Game":          g,
+		"Preview":       base64.RawStdEncoding.EncodeToString(previewImageBuf.Bytes()),
+		"RatingLogs":    ratingLogs,
+		"AccountNames":  accountNames,
+		"Tags":          tags,
+		"CanTag":        canTagGames(r),
+		"IsModerator":   isModerator,
+		"UserID":        sessionGetUserID(r),
+		"ModerationLog": moderationLog,
+		"Related":       related,
+	})
 }
 
 func DbGamesHandler(w http.ResponseWriter, r *http.Request) {
@@ -205,65 +166,49 @@ func APIgetGames(_ http.ResponseWriter, r *http.Request) (int, any) {
 	}
 	reqSortOrder := parseQueryStringFiltered(r, "order", "desc", "asc")
 	fieldmappings := map[string]string{
-		"TimeStarted": "time_started",
-		"TimeEnded":   "time_ended",
-		"ID":          "id",
-		"MapName":     "map_name",
-		"GameTime":    "game_time",
-	}
-	reqSortField := parseQueryStringMapped(r, "sort", "time_started", fieldmappings)
-
-	reqFilterJ := parseQueryString(r, "filter", "")
-	reqFilterFields := map[string]string{}
-	reqDoFilters := false
-	if reqFilterJ != "" {
-		err := json.Unmarshal([]byte(reqFilterJ), &reqFilterFields)
-		if err == nil && len(reqFilterFields) > 0 {
-			reqDoFilters = true
-		}
+		"TimeStarted": "g.time_started",
+		"TimeEnded":   "g.time_ended",
+		"ID":          "g.id",
+		"MapName":     "g.map_name",
+		"GameTime":    "g.game_time",
 	}
+	reqSortField := parseQueryStringMapped(r, "sort", "g.time_started", fieldmappings)
 
-	whereplayerscase := ""
-	wherecase := "WHERE deleted = false AND hidden = false"
-	whereargs := []any{}
-	if isSuperadmin(r.Context(), sessionGetUsername(r)) {
-		wherecase = ""
+	filter := store.GameFilter{}
+	if !isSuperadmin(r.Context(), sessionGetUsername(r)) {
+		filter.Conds = append(filter.Conds, "g.deleted = false", "g.hidden = false")
 	}
-	playerPubKey := parseQueryString(r, "player", "")
-	if playerPubKey != "" {
-		whereplayerscase = "where $1 = encode(i.pkey, 'hex')"
-		whereargs = append(whereargs, playerPubKey)
-		if wherecase == "" {
-			wherecase = "WHERE g.id = any((select game from plf))"
-		} else {
-			wherecase += " AND g.id = any((select game from plf))"
-		}
-	}
-	if reqDoFilters {
-		val, ok := reqFilterFields["MapName"]
-		if ok {
-			whereargs = append(whereargs, val)
-			if wherecase == "" {
-				wherecase = "WHERE g.map_name = $1"
-			} else {
-				wherecase += fmt.Sprintf(" AND g.map_name = $%d", len(whereargs))
-			}
-		}
+	err := parseGamesFilter(r, &filter)
+	if err != nil {
+		return 400, err
 	}
+	wherecase := filter.Where()
+	whereargs := filter.Args
 
 	reqSearch := parseQueryString(r, "search", "")
 
-	ordercase := fmt.Sprintf("ORDER BY %s %s", reqSortField, reqSortOrder)
-	orderargs := []any{}
-
-	if reqSearch != "" {
-		orderargs = append(orderargs, reqSearch)
-		argnum := len(whereargs) + 1
-		ordercase = fmt.Sprintf("ORDER BY max(similarity(coalesce(i.name, a.display_name), $%d::text)) desc, %s %s", argnum, reqSortField, reqSortOrder)
+	// search orders by relevance which has no stable key to continue from
+	cursor, err := parsePageCursor(r, reqSortField, reqSortOrder)
+	if err != nil || (cursor != nil && reqSearch != "") {
+		return 400, errBadCursor
 	}
+	totalsMode := parseTotalsMode(r, cursor != nil)
 
-	limiter := fmt.Sprintf("LIMIT %d", reqLimit)
-	offset := fmt.Sprintf("OFFSET %d", reqOffset)
+	page := store.ListGamesParams{
+		Filter:    store.GameFilter{Conds: filter.Conds, Args: append([]any{}, whereargs...)},
+		OrderBy:   fmt.Sprintf("%s %s", reqSortField, reqSortOrder),
+		Search:    reqSearch,
+		Limit:     reqLimit,
+		Offset:    reqOffset,
+		SortValue: reqSortField,
+	}
+	if reqSortField != "g.id" {
+		page.OrderBy += fmt.Sprintf(", g.id %s", reqSortOrder)
+	}
+	if cursor != nil {
+		page.Filter.Conds = append(page.Filter.Conds, keysetCondition(reqSortField, "g.id", cursor, &page.Filter.Args))
+		page.Offset = 0
+	}
 
 	totalsc := make(chan int)
 	var totals int
@@ -273,18 +218,18 @@ func APIgetGames(_ http.ResponseWriter, r *http.Request) (int, any) {
 	var totalsNoFilter int
 	totalsNoFilterpresent := false
 
-	growsc := make(chan []Game)
-	var gms []Game
+	growsc := make(chan []*Game)
+	var gms []*Game
+	var next *pageCursor
 	gpresent := false
 
 	echan := make(chan error)
 	go func() {
-		var c int
-		req := `select count(*) from games where hidden = false and deleted = false;`
+		req := `select 1 from games where hidden = false and deleted = false`
 		if isSuperadmin(r.Context(), sessionGetUsername(r)) {
-			req = `select count(*) from games;`
+			req = `select 1 from games`
 		}
-		derr := dbpool.QueryRow(r.Context(), req).Scan(&c)
+		c, derr := countRows(r.Context(), totalsMode, req)
 		if derr != nil {
 			log.Println(derr)
 			echan <- derr
@@ -293,23 +238,9 @@ func APIgetGames(_ http.ResponseWriter, r *http.Request) (int, any) {
 		totalsNoFilterc <- c
 	}()
 	go func() {
-		var c int
-		req := `with plf as (
-	select *
-	from players as p
-	join identities as i on i.id = p.identity
-	left join accounts as a on a.id = i.account
-	` + whereplayerscase + `
-)
-select
-	count(distinct g.id)
-from games as g
-join players as p on p.game = g.id
-join identities as i on i.id = p.identity
-` + wherecase + `
-;`
+		req := `select 1 from games as g ` + wherecase
 		// log.Printf("req %s args %#+v", req, whereargs)
-		derr := dbpool.QueryRow(r.Context(), req, whereargs...).Scan(&c)
+		c, derr := countRows(r.Context(), totalsMode, req, whereargs...)
 		if derr != nil {
 			log.Println(derr)
 			echan <- derr
@@ -319,73 +250,15 @@ join identities as i on i.id = p.identity
 	}()
 
 	go func() {
-		req := `with plf as (
-	select *
-	from players as p
-	join identities as i on i.id = p.identity
-	left join accounts as a on a.id = i.account
-	` + whereplayerscase + `
-)
-select
-	g.id, g.version, g.time_started, g.time_ended, g.game_time,
-	g.setting_scavs, g.setting_alliance, g.setting_power, g.setting_base,
-	g.map_name, g.map_hash, g.mods, g.deleted, g.hidden, g.calculated, g.debug_triggered,
-	g.display_category,
-	json_agg(json_build_object(
-		'Position', p.position,
-		'Name', i.name,
-		'Team', p.team,
-		'Usertype', p.usertype,
-		'Color', p.color,
-		'Identity', i.id,
-		'IdentityPubKey', encode(i.pkey, 'hex'),
-		'Account', a.id,
-		'DisplayName', coalesce(i.name, a.display_name),
-		'Rating', (select r from rating as r where r.category = g.display_category and r.account = i.account)
-	)) as players
-from games as g
-join players as p on p.game = g.id
-join identities as i on i.id = p.identity
-left join accounts as a on a.id = i.account
-` + wherecase + `
-group by g.id
-` + ordercase + `
-` + limiter + `
-` + offset
-		args := append(whereargs, orderargs...)
-		// log.Printf("req %s args %#+v", req, args)
-		gmsStage := []Game{}
-		rows, err := dbpool.Query(r.Context(), req, args...)
+		gmsStage, err := store.ListGames(r.Context(), dbpool, page)
 		if err != nil {
 			log.Println(err)
 			echan <- err
 			return
 		}
-		for rows.Next() {
-			g := Game{}
-			playersJSON := ""
-			err = rows.Scan(&g.ID, &g.Version, &g.TimeStarted, &g.TimeEnded, &g.GameTime,
-				&g.SettingScavs, &g.SettingAlliance, &g.SettingPower, &g.SettingBase,
-				&g.MapName, &g.MapHash, &g.Mods, &g.Deleted, &g.Hidden, &g.Calculated, &g.DebugTriggered, &g.DisplayCategory,
-				&playersJSON)
-			if err != nil {
-				echan <- err
-				return
-			}
-			g.Players = []Player{}
-			err = json.Unmarshal([]byte(playersJSON), &g.Players)
-			if err != nil {
-				echan <- err
-				return
-			}
-			slices.SortFunc(g.Players, func(a Player, b Player) int {
-				return a.Position - b.Position
-			})
-			gmsStage = append(gmsStage, g)
-		}
-		if err != nil {
-			echan <- err
-			return
+		if len(gmsStage) > 0 {
+			last := gmsStage[len(gmsStage)-1]
+			next = &pageCursor{Sort: reqSortField, Order: reqSortOrder, Value: last.SortValue, Key: strconv.Itoa(last.ID)}
 		}
 		growsc <- gmsStage
 	}()
@@ -404,11 +277,14 @@ group by g.id
 			totalsNoFilterpresent = true
 		}
 	}
-	return 200, map[string]any{
-		"total":            totals,
-		"totalNotFiltered": totalsNoFilter,
-		"rows":             gms,
+	ret := map[string]any{
+		"rows": gms,
+	}
+	addTotals(ret, totalsMode, totals, totalsNoFilter)
+	if next != nil && reqSearch == "" && len(gms) == reqLimit {
+		ret["next"] = next.String()
 	}
+	return 200, ret
 }
 
 func GameTimeToString(t any) string {
@@ -448,7 +324,6 @@ func GameTimeInterToString(t any) string {
 	}
 }
 
-//lint:ignore U1000 for later
 func SecondsToString(t float64) string {
 	return (time.Duration(int(t)) * time.Second).String()
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/warzone2100/autohoster-frontend/store"
+)
+
+type gamesExportColumn struct {
+	name string
+	expr string
+}
+
+var gamesExportGameColumns = []gamesExportColumn{
+	{"id", "g.id"},
+	{"time_started", "g.time_started"},
+	{"time_ended", "g.time_ended"},
+	{"game_time", "g.game_time"},
+	{"version", "g.version"},
+	{"map_name", "g.map_name"},
+	{"map_hash", "g.map_hash"},
+	{"setting_base", "g.setting_base"},
+	{"setting_alliance", "g.setting_alliance"},
+	{"setting_scavs", "g.setting_scavs"},
+	{"setting_power", "g.setting_power"},
+	{"mods", "g.mods"},
+	{"debug_triggered", "g.debug_triggered"},
+	{"display_category", "g.display_category"},
+}
+
+var gamesExportPlayerColumns = []gamesExportColumn{
+	{"position", "p.position"},
+	{"team", "p.team"},
+	{"usertype", "p.usertype"},
+	{"color", "p.color"},
+	{"identity", "i.id"},
+	{"identity_pkey", "encode(i.pkey, 'hex')"},
+	{"account", "i.account"},
+	{"name", "i.name"},
+	{"rating_diff", "(select d.diff from games_rating_diff as d where d.game = g.id and d.category = g.display_category and d.account = i.account)"},
+}
+
+// gamesExportLimiter allows each account a number of exports per hour and one at a time,
+// total amount of running exports is limited too since each holds database connection
+var gamesExportLimiter = struct {
+	sync.Mutex
+	started map[int][]time.Time
+	running map[int]bool
+	total   int
+}{
+	started: map[int][]time.Time{},
+	running: map[int]bool{},
+}
+
+var errGamesExportLimited = errors.New("export rate limit reached, try again later")
+
+func gamesExportAcquire(account int) error {
+	now := time.Now()
+	l := &gamesExportLimiter
+	l.Lock()
+	defer l.Unlock()
+	recent := []time.Time{}
+	for _, t := range l.started[account] {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	l.started[account] = recent
+	if l.running[account] || len(recent) >= cfg.GetDInt(10, "exportPerHour") || l.total >= cfg.GetDInt(4, "exportMaxConcurrent") {
+		return errGamesExportLimited
+	}
+	l.started[account] = append(recent, now)
+	l.running[account] = true
+	l.total++
+	return nil
+}
+
+func gamesExportRelease(account int) {
+	l := &gamesExportLimiter
+	l.Lock()
+	defer l.Unlock()
+	delete(l.running, account)
+	l.total--
+}
+
+func gamesExportQuery(perPlayer bool, filter *store.GameFilter) (string, []string) {
+	columns := gamesExportGameColumns
+	from := "games as g"
+	order := "g.id"
+	if perPlayer {
+		columns = append(append([]gamesExportColumn{}, columns...), gamesExportPlayerColumns...)
+		from = "games as g join players as p on p.game = g.id join identities as i on i.id = p.identity"
+		order = "g.id, p.position"
+	} else {
+		columns = append(append([]gamesExportColumn{}, columns...), gamesExportColumn{"players", "(select count(*) from players as ep where ep.game = g.id and ep.usertype != 'spectator')"})
+	}
+	names := make([]string, len(columns))
+	exprs := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+		exprs[i] = c.expr + " as " + c.name
+	}
+	return `select ` + strings.Join(exprs, ", ") + ` from ` + from + ` ` + filter.Where() + ` order by ` + order, names
+}
+
+// APIexportGames streams games matching /api/games filters as ndjson or csv,
+// rows=players gives one line per player in the game instead of one per game
+func APIexportGames(w http.ResponseWriter, r *http.Request) (int, any) {
+	if !checkUserAuthorized(r) {
+		return 401, errors.New("export requires authorization")
+	}
+	filter := store.GameFilter{}
+	if !isSuperadmin(r.Context(), sessionGetUsername(r)) {
+		filter.Conds = append(filter.Conds, "g.deleted = false", "g.hidden = false")
+	}
+	err := parseGamesFilter(r, &filter)
+	if err != nil {
+		return 400, err
+	}
+	format := parseQueryStringFiltered(r, "format", "ndjson", "csv")
+	perPlayer := parseQueryStringFiltered(r, "rows", "games", "players") == "players"
+	query, columns := gamesExportQuery(perPlayer, &filter)
+
+	account := sessionGetUserID(r)
+	err = gamesExportAcquire(account)
+	if err != nil {
+		return 429, err
+	}
+	defer gamesExportRelease(account)
+
+	if format == "ndjson" {
+		query = `select row_to_json(e)::text from (` + query + `) as e`
+	} else {
+		casted := make([]string, len(columns))
+		for i, c := range columns {
+			casted[i] = "e." + c + "::text"
+		}
+		query = `select ` + strings.Join(casted, ", ") + ` from (` + query + `) as e`
+	}
+	rows, err := dbpool.Query(r.Context(), query, filter.Args...)
+	if err != nil {
+		return 500, err
+	}
+	defer rows.Close()
+
+	kind := "games"
+	if perPlayer {
+		kind = "players"
+	}
+	name := fmt.Sprintf("autohoster-%s-%s.%s", kind, time.Now().Format("20060102-150405"), format)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+	var c *csv.Writer
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		c = csv.NewWriter(w)
+		c.Write(columns)
+	}
+	flusher, _ := w.(http.Flusher)
+	values := make([]*string, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	record := make([]string, len(columns))
+	n := 0
+	for rows.Next() {
+		if c == nil {
+			var line string
+			err = rows.Scan(&line)
+			if err == nil {
+				_, err = w.Write([]byte(line + "\n"))
+			}
+		} else {
+			err = rows.Scan(dest...)
+			if err == nil {
+				for i, v := range values {
+					record[i] = ""
+					if v != nil {
+						record[i] = *v
+					}
+				}
+				err = c.Write(record)
+			}
+		}
+		if err != nil {
+			break
+		}
+		n++
+		if n%1000 == 0 {
+			if c != nil {
+				c.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if c != nil {
+		c.Flush()
+	}
+	if err != nil {
+		log.Printf("Games export for account %d interrupted after %d rows: %s", account, n, err.Error())
+	}
+	return -1, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/warzone2100/autohoster-frontend/store"
+)
+
+var gamesFilterPubKeyRegexp = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+
+func gamesFilterKeys(r *http.Request, field string) ([]string, error) {
+	v := parseQueryString(r, field, "")
+	if v == "" {
+		return nil, nil
+	}
+	keys := strings.Split(v, ",")
+	for i, k := range keys {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if !gamesFilterPubKeyRegexp.MatchString(k) {
+			return nil, fmt.Errorf("%s: malformed public key %q", field, k)
+		}
+		keys[i] = k
+	}
+	return keys, nil
+}
+
+func gamesFilterInt(r *http.Request, field string) (*int, error) {
+	v := parseQueryString(r, field, "")
+	if v == "" {
+		return nil, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+	return &i, nil
+}
+
+func gamesFilterBool(r *http.Request, field string) (*bool, error) {
+	v := parseQueryString(r, field, "")
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+	return &b, nil
+}
+
+// gamesFilterTime accepts RFC3339 timestamps, plain dates and unix seconds
+func gamesFilterTime(r *http.Request, field string) (*time.Time, error) {
+	v := parseQueryString(r, field, "")
+	if v == "" {
+		return nil, nil
+	}
+	if u, err := strconv.ParseInt(v, 10, 64); err == nil {
+		t := time.Unix(u, 0)
+		return &t, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: unknown time format", field)
+}
+
+// parseGamesFilter builds games list conditions from query parameters:
+//
+//	timeFrom, timeTo - start time range
+//	version, mods - exact match
+//	base, alliance, scavs, power - game settings
+//	playersMin, playersMax - count of non-spectator players
+//	durationMin, durationMax - game time in seconds
+//	category - rating category the game counts towards
+//	hasReplay, debugTriggered - true/false
+//	player - games with this public key (hex)
+//	players - comma separated public keys, games with all of them
+//	opponents - two comma separated public keys, games where they were on different teams
+//	tags - comma separated tags, games having all of them
+//	filter - bootstrap-table filter json, only MapName is supported
+func parseGamesFilter(r *http.Request, f *store.GameFilter) error {
+	if t, err := gamesFilterTime(r, "timeFrom"); err != nil {
+		return err
+	} else if t != nil {
+		f.Conds = append(f.Conds, "g.time_started >= "+f.Arg(*t))
+	}
+	if t, err := gamesFilterTime(r, "timeTo"); err != nil {
+		return err
+	} else if t != nil {
+		f.Conds = append(f.Conds, "g.time_started <= "+f.Arg(*t))
+	}
+	if v := parseQueryString(r, "version", ""); v != "" {
+		f.Conds = append(f.Conds, "g.version = "+f.Arg(v))
+	}
+	if v := parseQueryString(r, "mapHash", ""); v != "" {
+		f.Conds = append(f.Conds, "g.map_hash = "+f.Arg(v))
+	}
+	if v, ok := r.URL.Query()["mods"]; ok && len(v) > 0 {
+		f.Conds = append(f.Conds, "g.mods = "+f.Arg(v[0]))
+	}
+	for _, s := range []struct{ field, column string }{
+		{"base", "g.setting_base"},
+		{"alliance", "g.setting_alliance"},
+		{"scavs", "g.setting_scavs"},
+		{"power", "g.setting_power"},
+	} {
+		v, err := gamesFilterInt(r, s.field)
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			f.Conds = append(f.Conds, s.column+" = "+f.Arg(*v))
+		}
+	}
+	if v, err := gamesFilterInt(r, "category"); err != nil {
+		return err
+	} else if v != nil {
+		f.Conds = append(f.Conds, "exists (select 1 from games_rating_categories as grc where grc.game = g.id and grc.category = "+f.Arg(*v)+")")
+	}
+	playerCount := "(select count(*) from players as fp where fp.game = g.id and fp.usertype != 'spectator')"
+	for _, s := range []struct{ field, cond string }{
+		{"playersMin", playerCount + " >= "},
+		{"playersMax", playerCount + " <= "},
+		{"durationMin", "g.game_time >= 1000 * "},
+		{"durationMax", "g.game_time <= 1000 * "},
+	} {
+		v, err := gamesFilterInt(r, s.field)
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			f.Conds = append(f.Conds, s.cond+f.Arg(*v))
+		}
+	}
+	if v, err := gamesFilterBool(r, "hasReplay"); err != nil {
+		return err
+	} else if v != nil {
+		if *v {
+			f.Conds = append(f.Conds, "(g.replay is not null or g.replay_stored is not null)")
+		} else {
+			f.Conds = append(f.Conds, "g.replay is null and g.replay_stored is null")
+		}
+	}
+	if v, err := gamesFilterBool(r, "debugTriggered"); err != nil {
+		return err
+	} else if v != nil {
+		f.Conds = append(f.Conds, "g.debug_triggered = "+f.Arg(*v))
+	}
+	players, err := gamesFilterKeys(r, "players")
+	if err != nil {
+		return err
+	}
+	if p := parseQueryString(r, "player", ""); p != "" {
+		players = append(players, p)
+	}
+	for _, k := range players {
+		f.Conds = append(f.Conds, `exists (select 1 from players as fp join identities as fi on fi.id = fp.identity
+	where fp.game = g.id and encode(fi.pkey, 'hex') = `+f.Arg(k)+`)`)
+	}
+	// h2h matches both players by account like head to head summary does
+	h2h, err := gamesFilterKeys(r, "h2h")
+	if err != nil {
+		return err
+	}
+	if len(h2h) > 0 {
+		if len(h2h) != 2 {
+			return fmt.Errorf("h2h: exactly two public keys expected")
+		}
+		for _, k := range h2h {
+			f.Conds = append(f.Conds, `exists (select 1 from players as fp join identities as fi on fi.id = fp.identity
+	where fp.game = g.id and fp.usertype != 'spectator'
+		and coalesce(fi.account, -fi.id) = (select coalesce(ki.account, -ki.id) from identities as ki where encode(ki.pkey, 'hex') = `+f.Arg(k)+`))`)
+		}
+	}
+	opponents, err := gamesFilterKeys(r, "opponents")
+	if err != nil {
+		return err
+	}
+	if len(opponents) > 0 {
+		if len(opponents) != 2 {
+			return fmt.Errorf("opponents: exactly two public keys expected")
+		}
+		f.Conds = append(f.Conds, `exists (select 1
+	from players as fa join identities as fai on fai.id = fa.identity,
+		players as fb join identities as fbi on fbi.id = fb.identity
+	where fa.game = g.id and fb.game = g.id and fa.team != fb.team
+		and fa.usertype != 'spectator' and fb.usertype != 'spectator'
+		and encode(fai.pkey, 'hex') = `+f.Arg(opponents[0])+` and encode(fbi.pkey, 'hex') = `+f.Arg(opponents[1])+`)`)
+	}
+	if v := parseQueryString(r, "tags", ""); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			f.Conds = append(f.Conds, "exists (select 1 from game_tags as gt where gt.game = g.id and gt.tag = "+f.Arg(strings.ToLower(strings.TrimSpace(t)))+")")
+		}
+	}
+	if j := parseQueryString(r, "filter", ""); j != "" {
+		fields := map[string]string{}
+		if json.Unmarshal([]byte(j), &fields) == nil {
+			if v, ok := fields["MapName"]; ok {
+				f.Conds = append(f.Conds, "g.map_name = "+f.Arg(v))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// H2HPlayer is matched by account, Key is coalesce(account, -identity)
+// so identities without account still count as players
+type H2HPlayer struct {
+	Key            int
+	Identity       int
+	Name           string
+	IdentityPubKey string
+	Account        *int
+}
+
+type H2HGame struct {
+	ID          int
+	TimeStarted time.Time
+	MapName     string
+	Opponents   bool
+	AWon        bool
+	BWon        bool
+	ADiff       *int
+	BDiff       *int
+}
+
+type H2HMap struct {
+	MapName   string
+	Opponents int
+	AWins     int
+	BWins     int
+	Teammates int
+	Won       int
+}
+
+// H2HSummary is how two players did against and alongside each other,
+// rating diffs are summed over opponent games in each game's display category
+type H2HSummary struct {
+	A            H2HPlayer
+	B            H2HPlayer
+	Opponents    int
+	AWins        int
+	BWins        int
+	Teammates    int
+	TeammatesWon int
+	ARatingDiff  int
+	BRatingDiff  int
+	Maps         []*H2HMap
+	Games        []*H2HGame
+}
+
+var errH2HPlayerNotFound = errors.New("player not found")
+
+func h2hLookupPlayer(ctx context.Context, key string) (*H2HPlayer, error) {
+	spec, err := hex.DecodeString(key)
+	if err != nil || len(spec) == 0 {
+		return nil, errH2HPlayerNotFound
+	}
+	p := &H2HPlayer{}
+	err = dbpool.QueryRow(ctx, `select coalesce(account, -id), id, name, encode(pkey, 'hex'), account from identities where pkey = $1 or hash ^@ encode($1, 'hex') limit 1`, spec).
+		Scan(&p.Key, &p.Identity, &p.Name, &p.IdentityPubKey, &p.Account)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errH2HPlayerNotFound
+	}
+	return p, err
+}
+
+func GetHeadToHead(ctx context.Context, keyA, keyB string) (*H2HSummary, error) {
+	a, err := h2hLookupPlayer(ctx, keyA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := h2hLookupPlayer(ctx, keyB)
+	if err != nil {
+		return nil, err
+	}
+	ret := &H2HSummary{A: *a, B: *b, Maps: []*H2HMap{}, Games: []*H2HGame{}}
+	if a.Key == b.Key {
+		return ret, nil
+	}
+	maps := map[string]*H2HMap{}
+	var g H2HGame
+	var aDiff, bDiff *int
+	_, err = dbpool.QueryFunc(ctx, `select g.id, g.time_started, g.map_name, pa.team != pb.team, pa.usertype = 'winner', pb.usertype = 'winner',
+	(select d.diff from games_rating_diff as d where d.game = g.id and d.category = g.display_category and d.account = ia.account),
+	(select d.diff from games_rating_diff as d where d.game = g.id and d.category = g.display_category and d.account = ib.account)
+from games as g
+join players as pa on pa.game = g.id
+join identities as ia on ia.id = pa.identity and coalesce(ia.account, -ia.id) = $1
+join players as pb on pb.game = g.id
+join identities as ib on ib.id = pb.identity and coalesce(ib.account, -ib.id) = $2
+where g.deleted = false and g.hidden = false and pa.usertype != 'spectator' and pb.usertype != 'spectator'
+order by g.time_started desc`, []any{a.Key, b.Key},
+		[]any{&g.ID, &g.TimeStarted, &g.MapName, &g.Opponents, &g.AWon, &g.BWon, &aDiff, &bDiff},
+		func(_ pgx.QueryFuncRow) error {
+			// scan targets are reused between rows, diffs are copied for each game
+			gg := g
+			gg.ADiff, gg.BDiff = nil, nil
+			if aDiff != nil {
+				d := *aDiff
+				gg.ADiff = &d
+			}
+			if bDiff != nil {
+				d := *bDiff
+				gg.BDiff = &d
+			}
+			ret.Games = append(ret.Games, &gg)
+			m, ok := maps[g.MapName]
+			if !ok {
+				m = &H2HMap{MapName: g.MapName}
+				maps[g.MapName] = m
+				ret.Maps = append(ret.Maps, m)
+			}
+			if !g.Opponents {
+				ret.Teammates++
+				m.Teammates++
+				if g.AWon {
+					ret.TeammatesWon++
+					m.Won++
+				}
+				return nil
+			}
+			ret.Opponents++
+			m.Opponents++
+			if g.AWon {
+				ret.AWins++
+				m.AWins++
+			}
+			if g.BWon {
+				ret.BWins++
+				m.BWins++
+			}
+			if gg.ADiff != nil {
+				ret.ARatingDiff += *gg.ADiff
+			}
+			if gg.BDiff != nil {
+				ret.BRatingDiff += *gg.BDiff
+			}
+			return nil
+		})
+	return ret, err
+}
+
+func APIgetHeadToHead(_ http.ResponseWriter, r *http.Request) (int, any) {
+	ret, err := GetHeadToHead(r.Context(), parseQueryString(r, "a", ""), parseQueryString(r, "b", ""))
+	if err != nil {
+		if errors.Is(err, errH2HPlayerNotFound) {
+			return 404, err
+		}
+		return 500, err
+	}
+	return 200, ret
+}
+
+func H2HHandler(w http.ResponseWriter, r *http.Request) {
+	a, b := parseQueryString(r, "a", ""), parseQueryString(r, "b", "")
+	if a == "" || b == "" {
+		basicLayoutLookupRespond("h2h", w, r, map[string]any{"KeyA": a, "KeyB": b})
+		return
+	}
+	h, err := GetHeadToHead(r.Context(), a, b)
+	if err != nil {
+		if errors.Is(err, errH2HPlayerNotFound) {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msg": "Player not found, identity can be hex encoded public key or it's sha256 hash"})
+			return
+		}
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	basicLayoutLookupRespond("h2h", w, r, map[string]any{"KeyA": a, "KeyB": b, "H2H": h})
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -68,15 +71,7 @@ func hostRequestHandlerPOST(w http.ResponseWriter, r *http.Request) {
 		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msg": "Failed to fetch map info: " + err.Error()})
 		return
 	}
-	if !inf.Player.Units.Eq ||
-		!inf.Player.Structs.Eq ||
-		!inf.Player.ResourceExtr.Eq ||
-		!inf.Player.PwrGen.Eq ||
-		!inf.Player.RegFact.Eq ||
-		!inf.Player.VtolFact.Eq ||
-		!inf.Player.CyborgFact.Eq ||
-		!inf.Player.ResearchCent.Eq ||
-		!inf.Player.DefStruct.Eq {
+	if !mapInfoBalanced(inf) {
 		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msg": "Provided map does not meet balance requirements"})
 		return
 	}
@@ -109,34 +104,31 @@ where (a.id = any($1) or a.superadmin = true) and i.pkey is not null;`, r.Form["
 		return
 	}
 
+	hostCategory, err := GetHostCategory(r.Context())
+	if errors.Is(err, pgx.ErrNoRows) {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Rating season ended and there is no next one yet"})
+		return
+	}
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database query error: " + err.Error()})
+		return
+	}
+
 	ratingCategories := []int{}
 	switch r.Form.Get("ratingCategories") {
 	case "ratingNoCategories":
 		ratingCategories = []int{}
 	case "ratingRegular":
-		whitelistedMaps, ok := cfg.GetMapStringAny("whitelistedMaps")
-		if !ok {
-			whitelistedMaps = map[string]any{}
-		}
-		isWhitelisted := false
-		for _, v := range whitelistedMaps {
-			switch vv := v.(type) {
-			case map[string]any:
-				h, ok := vv["Hash"].(string)
-				if !ok {
-					continue
-				}
-				if h == inf.Download.Hash {
-					isWhitelisted = true
-					break
-				}
-			}
+		isWhitelisted, err := isHostMapWhitelisted(r.Context(), inf.Download.Hash, hostCategory)
+		if err != nil {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database query error: " + err.Error()})
+			return
 		}
 		if !isWhitelisted {
 			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Map is not whitelisted for rating"})
 			return
 		}
-		ratingCategories = []int{3}
+		ratingCategories = []int{hostCategory}
 	}
 
 	toSendPreset := map[string]any{
@@ -146,7 +138,7 @@ where (a.id = any($1) or a.superadmin = true) and i.pkey is not null;`, r.Form["
 		"allowNonLinkedPlay": parseFormBool(r, "allowNonRegisteredPlay"),
 		"allowNonLinkedChat": parseFormBool(r, "allowNonRegisteredChat"),
 		"timelimit":          timeLimit,
-		"displayCategory":    3,
+		"displayCategory":    hostCategory,
 		"ratingCategories":   ratingCategories,
 		"players":            inf.Slots,
 		"roomName":           roomName,
@@ -194,9 +186,20 @@ order by a.id`)
 		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database query error: " + err.Error()})
 		return
 	}
-	whitelistedMaps, ok := cfg.GetMapStringAny("whitelistedMaps")
-	if !ok {
-		whitelistedMaps = map[string]any{"not": "set"}
+	whitelist := []*MapWhitelistEntry{}
+	hostCategory, err := GetHostCategory(r.Context())
+	if err == nil {
+		whitelist, err = GetHostMapWhitelist(r.Context(), hostCategory)
+	} else if errors.Is(err, pgx.ErrNoRows) {
+		err = nil
+	}
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database query error: " + err.Error()})
+		return
+	}
+	whitelistedMaps := map[string]any{}
+	for _, m := range whitelist {
+		whitelistedMaps[m.Name] = map[string]any{"Hash": m.Hash, "Players": m.Players}
 	}
 	basicLayoutLookupRespond("hostrequest", w, r, map[string]any{
 		"Admins":          admins,
@@ -314,6 +317,8 @@ func wzlinkCheckHandler(w http.ResponseWriter, r *http.Request) {
 		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
 		return
 	}
+	logkeyHash := sha256.Sum256(logkey)
+	ratingLookupCacheInvalidateHash(hex.EncodeToString(logkeyHash[:]))
 	basicLayoutLookupRespond("wzlinkcheck", w, r, map[string]any{"LinkStatus": "done", "PlayerKey": logkey, "PlayerName": logname})
 }
 
@@ -10,14 +10,19 @@ import (
 
 	"github.com/georgysavva/scany/pgxscan"
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 type RatingCategory struct {
-	ID         int
-	TimeStarts **time.Time
-	TimeEnds   **time.Time
-	Name       string
+	ID          int
+	TimeStarts  **time.Time
+	TimeEnds    **time.Time
+	Name        string
+	Engine      string
+	Params      RatingParams
+	Archived    bool
+	Predecessor *int
 }
 
 func GetRatingCategories(ctx context.Context, db *pgxpool.Pool) ([]*RatingCategory, error) {
@@ -31,6 +36,9 @@ func GetRatingCategory(ctx context.Context, db *pgxpool.Pool, id int) (*RatingCa
 	if err != nil {
 		return nil, err
 	}
+	if len(r) == 0 {
+		return nil, pgx.ErrNoRows
+	}
 	if len(r) != 1 {
 		return nil, errors.New("rating category id collision, shit is on fire")
 	}
@@ -60,7 +68,17 @@ func LeaderboardsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	lb := map[*RatingCategory][]*LeaderboardEntry{}
+	seasons := map[*RatingCategory][]*RatingArchiveEntry{}
 	for _, c := range cats {
+		if c.Archived {
+			a, err := GetRatingArchiveTop(r.Context(), dbpool, c.ID, 3)
+			if err != nil {
+				basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": err.Error()})
+				return
+			}
+			seasons[c] = a
+			continue
+		}
 		l, err := GetLeaderboardTop(r.Context(), dbpool, c.ID, 3)
 		if err != nil {
 			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": err.Error()})
@@ -68,7 +86,7 @@ func LeaderboardsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		lb[c] = l
 	}
-	basicLayoutLookupRespond("leaderboards", w, r, map[string]any{"leaderboards": lb})
+	basicLayoutLookupRespond("leaderboards", w, r, map[string]any{"leaderboards": lb, "seasons": seasons})
 }
 
 func LeaderboardHandler(w http.ResponseWriter, r *http.Request) {
@@ -99,6 +117,42 @@ func APIgetLeaderboard(_ http.ResponseWriter, r *http.Request) (int, any) {
 	if err != nil {
 		return 500, err
 	}
+	c, err := GetRatingCategory(r.Context(), dbpool, category)
+	if err != nil {
+		return 500, err
+	}
+	if c.Archived {
+		return genericViewRequest[RatingArchiveEntry](r, genericRequestParams{
+			tableName:               "rating_archive",
+			cursorKey:               "account",
+			limitClamp:              500,
+			sortDefaultOrder:        "asc",
+			sortDefaultColumn:       "rank",
+			sortColumns:             []string{"display_name", "account", "rank", "elo", "played", "won", "lost", "time_played"},
+			filterColumnsFull:       []string{"account", "elo", "played", "won", "lost", "time_played"},
+			filterColumnsStartsWith: []string{"display_name"},
+			searchColumn:            "display_name",
+			searchSimilarity:        0.3,
+			addWhereCase:            fmt.Sprintf("category = %d", category),
+			columnMappings: map[string]string{
+				"Rank":        "rank",
+				"Won":         "won",
+				"Lost":        "lost",
+				"Elo":         "elo",
+				"DisplayName": "display_name",
+			},
+		})
+	}
+	wherecase := fmt.Sprintf("category = %d AND played > 0", category)
+	if parseQueryString(r, "hideInactive", "") == "true" {
+		inactiveDays := parseQueryInt(r, "inactiveDays", 0)
+		if inactiveDays <= 0 {
+			inactiveDays = int(c.Params.InactiveDays)
+		}
+		if inactiveDays > 0 {
+			wherecase += fmt.Sprintf(" AND account IN (SELECT account FROM rating WHERE category = %d AND time_last_played > now() - interval '%d days')", category, inactiveDays)
+		}
+	}
 	return genericViewRequest[struct {
 		DisplayName string
 		Account     int
@@ -110,6 +164,7 @@ func APIgetLeaderboard(_ http.ResponseWriter, r *http.Request) (int, any) {
 		TimePlayed  int
 	}](r, genericRequestParams{
 		tableName:               "leaderboard",
+		cursorKey:               "account",
 		limitClamp:              500,
 		sortDefaultOrder:        "desc",
 		sortDefaultColumn:       "elo",
@@ -118,7 +173,7 @@ func APIgetLeaderboard(_ http.ResponseWriter, r *http.Request) (int, any) {
 		filterColumnsStartsWith: []string{"display_name"},
 		searchColumn:            "display_name",
 		searchSimilarity:        0.3,
-		addWhereCase:            fmt.Sprintf("category = %d AND played > 0", category),
+		addWhereCase:            wherecase,
 		columnMappings: map[string]string{
 			"Won":         "won",
 			"Lost":        "lost",
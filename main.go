@@ -35,6 +35,7 @@ var (
 var (
 	LobbyWSHub     *WSHub
 	GamesWSHub     *WSHub
+	RatingWSHub    *WSHub
 	layouts        *template.Template
 	sessionManager *scs.SessionManager
 	dbpool         *pgxpool.Pool
@@ -246,6 +247,12 @@ func main() {
 	}
 	defer dbpool.Close()
 
+	log.Println("Opening replay storage")
+	err = openReplayStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	log.Println("Starting session manager")
 	sessionManager = scs.New()
 	store := pgxstore.New(dbpool)
@@ -256,8 +263,34 @@ func main() {
 	log.Println("Starting websocket hubs")
 	LobbyWSHub = NewWSHub()
 	GamesWSHub = NewWSHub()
+	RatingWSHub = NewWSHub()
 	go LobbyWSHub.Run()
 	go GamesWSHub.Run()
+	go RatingWSHub.Run()
+
+	log.Println("Loading rating lookup rules")
+	err = loadRatingLookupConfig(context.Background())
+	if err != nil {
+		log.Printf("Failed to load rating lookup rules, using defaults: %s", err.Error())
+	}
+
+	log.Println("Starting rating recalculation runner")
+	go ratingRecalcRunner()
+
+	log.Println("Starting rating decay runner")
+	go ratingDecayRunner()
+
+	log.Println("Starting rating lookup cache watcher")
+	go ratingLookupCacheWatcher()
+
+	log.Println("Starting season runner")
+	go seasonRunner()
+
+	log.Println("Starting rating abuse detector")
+	go ratingAbuseRunner()
+
+	log.Println("Starting replay ingestion runner")
+	go replayIngestRunner()
 
 	log.Println("Starting lobby poller")
 	loadLobbyIgnores(cfg.GetDSString("./lobbyIgnores.txt", "lobbyIgnores"))
@@ -320,6 +353,24 @@ func main() {
 	router.HandleFunc("/moderation/ratingCategories", basicSuperadminHandler("modRatingCategories")).Methods("GET")
 	router.HandleFunc("/api/ratingCategories", APIcall(APIgetRatingCategories)).Methods("GET", "OPTIONS")
 
+	router.HandleFunc("/moderation/ratingLookup", SuperadminCheck(modRatingLookupHandler)).Methods("GET")
+	router.HandleFunc("/moderation/ratingLookup", SuperadminCheck(modRatingLookupPOST)).Methods("POST")
+	router.HandleFunc("/api/ratingLookup/preview", APIcall(APISuperadminCheck(APIratingLookupPreview))).Methods("POST")
+
+	router.HandleFunc("/moderation/ratingRecalc", basicSuperadminHandler("modRatingRecalc")).Methods("GET")
+	router.HandleFunc("/moderation/ratingRecalc", SuperadminCheck(modRatingRecalcPOST)).Methods("POST")
+	router.HandleFunc("/api/ratingRecalc", APIcall(APISuperadminCheck(APIgetRatingRecalcJobs))).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/ratingRecalc/{id:[0-9]+}", APIcall(APISuperadminCheck(APIgetRatingRecalcJob))).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/ratingRecalc/dryrun/{category:[0-9]+}", APIcall(APISuperadminCheck(APIgetRatingDryRun))).Methods("GET", "OPTIONS")
+
+	router.HandleFunc("/moderation/ratingAbuse", basicSuperadminHandler("modRatingAbuse")).Methods("GET")
+	router.HandleFunc("/moderation/ratingAbuse", SuperadminCheck(modRatingAbusePOST)).Methods("POST")
+	router.HandleFunc("/api/ratingAbuse", APIcall(APISuperadminCheck(APIgetRatingAbuseFlags))).Methods("GET", "OPTIONS")
+
+	router.HandleFunc("/moderation/mapWhitelist", SuperadminCheck(modMapWhitelistHandler)).Methods("GET")
+	router.HandleFunc("/moderation/mapWhitelist", SuperadminCheck(modMapWhitelistPOST)).Methods("POST")
+	router.HandleFunc("/api/mapWhitelist", APIcall(APIgetMapWhitelist)).Methods("GET", "OPTIONS")
+
 	router.HandleFunc("/moderation/reloadConfig", modReloadConfig).Methods("GET")
 
 	router.HandleFunc("/rating/{hash:[0-9a-z]+}", ratingHandler)
@@ -328,9 +379,21 @@ func main() {
 
 	router.HandleFunc("/games", DbGamesHandler)
 	router.HandleFunc(`/games/{id}`, DbGameDetailsHandler)
+	router.HandleFunc("/maps/{hash:[0-9a-f]+}", MapStatsHandler)
 	router.HandleFunc("/api/games", APIcall(APIgetGames)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/games/export", APIcall(APIexportGames)).Methods("GET")
+	router.HandleFunc("/api/games/{id:[0-9]+}/ratinglog", APIcall(APIgetGameRatingLog)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/games/{id:[0-9]+}/bundle", APIcall(APIgetGameBundle)).Methods("GET")
+	router.HandleFunc("/api/games/{id:[0-9]+}/tags", APIcall(APIgetGameTags)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/games/{id:[0-9]+}/related", APIcall(APIgetRelatedGames)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/games/{id:[0-9]+}/tags", gameTagsPOST).Methods("POST")
+	router.HandleFunc("/moderation/games/{id:[0-9]+}", SuperadminCheck(modGameActionPOST)).Methods("POST")
 
 	router.HandleFunc("/players/{id:[0-9a-f]+}", PlayersHandler)
+	router.HandleFunc("/api/players/{identity:[0-9a-f]+}/rating-history", APIcall(APIgetPlayerRatingHistory)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/players/{identity:[0-9a-f]+}/activity", APIcall(APIgetPlayerActivity)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/h2h", H2HHandler).Methods("GET")
+	router.HandleFunc("/api/h2h", APIcall(APIgetHeadToHead)).Methods("GET", "OPTIONS")
 
 	router.HandleFunc("/leaderboards", LeaderboardsHandler)
 	router.HandleFunc("/leaderboards/{category:[0-9]+}", LeaderboardHandler).Methods("GET")
@@ -340,10 +403,14 @@ func main() {
 	router.HandleFunc("/api/ws/lobby", func(w http.ResponseWriter, r *http.Request) {
 		APIWSHub(LobbyWSHub, w, r)
 	})
+	router.HandleFunc("/api/ws/rating", SuperadminCheck(func(w http.ResponseWriter, r *http.Request) {
+		APIWSHub(RatingWSHub, w, r)
+	}))
 
 	router.HandleFunc("/api/backend/alive", APItryReachBackend).Methods("GET")
 
 	router.HandleFunc("/api/graph/{gid:[0-9]+}", APIcall(APIgetGraphData)).Methods("GET")
+	router.HandleFunc("/api/activity/{gid:[0-9]+}", APIcall(APIgetReplayActivity)).Methods("GET")
 	router.HandleFunc("/api/classify/game/{gid:[0-9]+}", APIcall(APIgetClassChartGame)).Methods("GET")
 	router.HandleFunc("/api/classify/player/{pid:[0-9]+}", APIcall(APIresearchClassification)).Methods("GET")
 	router.HandleFunc("/api/reslog/{gid:[0-9]+}", APIcall(APIgetResearchlogData)).Methods("GET")
@@ -357,8 +424,7 @@ func main() {
 	router.HandleFunc("/api/dayavg", APIcall(APIgetDayAverageByHour)).Methods("GET")
 	router.HandleFunc("/api/playersavg", APIcall(APIgetUniquePlayersPerDay)).Methods("GET")
 	router.HandleFunc("/api/mapcount", APIcall(APIgetMapNameCount)).Methods("GET")
-
-	// router.HandleFunc("/elo/calc", EloRecalcHandler)
+	router.HandleFunc("/api/maps/{hash:[0-9a-f]+}", APIcall(APIgetMapStats)).Methods("GET", "OPTIONS")
 
 	// handlers.CompressHandler(router1)
 	// handlers.RecoveryHandler()(router3)
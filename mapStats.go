@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image/png"
+	"math"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// MapSideStats is outcome of a starting position or a team, rated part only counts
+// games where every player had rating before the game
+type MapSideStats struct {
+	Side           int
+	Played         int
+	Won            int
+	WinRate        float64
+	RatedPlayed    int
+	RatedWon       int
+	ExpectedWins   float64
+	ExpectedRate   float64
+	RatedAdvantage float64
+}
+
+type MapStats struct {
+	Hash        string
+	Name        string
+	Games       int
+	RatedGames  int
+	AvgGameTime float64
+	Positions   []*MapSideStats
+	Teams       []*MapSideStats
+	// Balance is the biggest difference between actual and rating expected win rate
+	// of a team, 0 is perfectly balanced
+	Balance float64
+}
+
+func (s *MapSideStats) finish() {
+	if s.Played > 0 {
+		s.WinRate = float64(s.Won) / float64(s.Played)
+	}
+	if s.RatedPlayed > 0 {
+		s.ExpectedRate = s.ExpectedWins / float64(s.RatedPlayed)
+		s.RatedAdvantage = float64(s.RatedWon)/float64(s.RatedPlayed) - s.ExpectedRate
+	}
+}
+
+type mapStatsPlayer struct {
+	position int
+	team     int
+	won      bool
+	rating   *int
+}
+
+func mapStatsSide(m map[int]*MapSideStats, side int) *MapSideStats {
+	s, ok := m[side]
+	if !ok {
+		s = &MapSideStats{Side: side}
+		m[side] = s
+	}
+	return s
+}
+
+// mapStatsAddGame accounts finished game, expected outcome is only known
+// for two team games with every player rated
+func mapStatsAddGame(ret *MapStats, positions, teams map[int]*MapSideStats, players []mapStatsPlayer) {
+	teamRating := map[int][2]int{}
+	rated := true
+	for _, p := range players {
+		pos := mapStatsSide(positions, p.position)
+		pos.Played++
+		if p.won {
+			pos.Won++
+		}
+		if p.rating == nil {
+			rated = false
+			continue
+		}
+		tr := teamRating[p.team]
+		teamRating[p.team] = [2]int{tr[0] + *p.rating, tr[1] + 1}
+	}
+	won := map[int]bool{}
+	for _, p := range players {
+		won[p.team] = won[p.team] || p.won
+	}
+	for t, w := range won {
+		team := mapStatsSide(teams, t)
+		team.Played++
+		if w {
+			team.Won++
+		}
+	}
+	if !rated || len(teamRating) != 2 {
+		return
+	}
+	ret.RatedGames++
+	avg := map[int]float64{}
+	for t, tr := range teamRating {
+		avg[t] = float64(tr[0]) / float64(tr[1])
+	}
+	expected := map[int]float64{}
+	for t := range avg {
+		for o := range avg {
+			if o != t {
+				expected[t] = 1 / (1 + math.Pow(10, (avg[o]-avg[t])/400))
+			}
+		}
+	}
+	for t, e := range expected {
+		team := teams[t]
+		team.RatedPlayed++
+		team.ExpectedWins += e
+		if won[t] {
+			team.RatedWon++
+		}
+	}
+	for _, p := range players {
+		pos := positions[p.position]
+		pos.RatedPlayed++
+		pos.ExpectedWins += expected[p.team]
+		if p.won {
+			pos.RatedWon++
+		}
+	}
+}
+
+// GetMapStats aggregates finished visible games on the map, rating before the game
+// is taken from display category rating diffs
+func GetMapStats(ctx context.Context, hash string) (*MapStats, error) {
+	ret := &MapStats{Hash: hash, Positions: []*MapSideStats{}, Teams: []*MapSideStats{}}
+	err := dbpool.QueryRow(ctx, `select coalesce(mode() within group (order by map_name), ''), count(*), coalesce(avg(game_time) / 1000, 0)
+from games
+where map_hash = $1 and deleted = false and hidden = false and game_time is not null`, hash).Scan(&ret.Name, &ret.Games, &ret.AvgGameTime)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Games == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	positions := map[int]*MapSideStats{}
+	teams := map[int]*MapSideStats{}
+	var (
+		gid, lastGid int
+		p            mapStatsPlayer
+		rating       *int
+		players      []mapStatsPlayer
+	)
+	_, err = dbpool.QueryFunc(ctx, `select g.id, p.position, p.team, p.usertype = 'winner', d.elo - d.diff
+from games as g
+join players as p on p.game = g.id
+join identities as i on i.id = p.identity
+left join games_rating_diff as d on d.game = g.id and d.category = g.display_category and d.account = i.account
+where g.map_hash = $1 and g.deleted = false and g.hidden = false and g.game_time is not null
+	and p.usertype = any('{winner,loser}')
+order by g.id, p.position`, []any{hash}, []any{&gid, &p.position, &p.team, &p.won, &rating},
+		func(_ pgx.QueryFuncRow) error {
+			// scan target is reused between rows, every player needs own copy
+			p.rating = nil
+			if rating != nil {
+				r := *rating
+				p.rating = &r
+			}
+			if gid != lastGid && len(players) > 0 {
+				mapStatsAddGame(ret, positions, teams, players)
+				players = players[:0]
+			}
+			lastGid = gid
+			players = append(players, p)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	if len(players) > 0 {
+		mapStatsAddGame(ret, positions, teams, players)
+	}
+	for _, s := range positions {
+		s.finish()
+		ret.Positions = append(ret.Positions, s)
+	}
+	for _, s := range teams {
+		s.finish()
+		ret.Teams = append(ret.Teams, s)
+		if s.RatedPlayed > 0 {
+			ret.Balance = math.Max(ret.Balance, math.Abs(s.RatedAdvantage))
+		}
+	}
+	bySide := func(a, b *MapSideStats) int { return a.Side - b.Side }
+	slices.SortFunc(ret.Positions, bySide)
+	slices.SortFunc(ret.Teams, bySide)
+	return ret, nil
+}
+
+func APIgetMapStats(_ http.ResponseWriter, r *http.Request) (int, any) {
+	s, err := GetMapStats(r.Context(), mux.Vars(r)["hash"])
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return 404, nil
+		}
+		return 500, err
+	}
+	return 200, s
+}
+
+func MapStatsHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	s, err := GetMapStats(r.Context(), hash)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "No games played on this map"})
+			return
+		}
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	preview := ""
+	previewImage, err := getMapPreviewWithColors(hash, [10]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	if err == nil {
+		buf := bytes.NewBuffer(nil)
+		if png.Encode(buf, previewImage) == nil {
+			preview = base64.RawStdEncoding.EncodeToString(buf.Bytes())
+		}
+	}
+	basicLayoutLookupRespond("mapstats", w, r, map[string]any{
+		"Map":     s,
+		"Preview": preview,
+	})
+}
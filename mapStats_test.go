@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func ratingPtr(v int) *int {
+	return &v
+}
+
+func TestMapStatsAddGame(t *testing.T) {
+	ret := &MapStats{}
+	positions := map[int]*MapSideStats{}
+	teams := map[int]*MapSideStats{}
+	mapStatsAddGame(ret, positions, teams, []mapStatsPlayer{
+		{position: 0, team: 0, won: true, rating: ratingPtr(1600)},
+		{position: 1, team: 1, won: false, rating: ratingPtr(1400)},
+		{position: 2, team: 0, won: true, rating: ratingPtr(1800)},
+		{position: 3, team: 1, won: false, rating: ratingPtr(1200)},
+	})
+	if ret.RatedGames != 1 {
+		t.Fatalf("rated games %d", ret.RatedGames)
+	}
+	// team 0 averages 1700 against 1300
+	want := 1 / (1 + math.Pow(10, -400.0/400))
+	if e := teams[0].ExpectedWins; math.Abs(e-want) > 1e-9 {
+		t.Fatalf("team 0 expected %f, want %f", e, want)
+	}
+	if e := teams[1].ExpectedWins; math.Abs(e-(1-want)) > 1e-9 {
+		t.Fatalf("team 1 expected %f, want %f", e, 1-want)
+	}
+	if teams[0].Won != 1 || teams[0].RatedWon != 1 || teams[1].Won != 0 || teams[1].Played != 1 {
+		t.Fatalf("team results %+v %+v", teams[0], teams[1])
+	}
+	if e := positions[3].ExpectedWins; math.Abs(e-(1-want)) > 1e-9 {
+		t.Fatalf("position 3 expected %f, want %f", e, 1-want)
+	}
+
+	// unrated player leaves the game out of rated stats
+	mapStatsAddGame(ret, positions, teams, []mapStatsPlayer{
+		{position: 0, team: 0, won: false, rating: ratingPtr(1600)},
+		{position: 1, team: 1, won: true},
+	})
+	if ret.RatedGames != 1 || teams[1].Played != 2 || teams[1].RatedPlayed != 1 {
+		t.Fatalf("unrated game counted as rated: %d %+v", ret.RatedGames, teams[1])
+	}
+	for _, s := range teams {
+		s.finish()
+	}
+	if math.Abs(teams[0].RatedAdvantage-(1-want)) > 1e-9 {
+		t.Fatalf("team 0 advantage %f", teams[0].RatedAdvantage)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	mapsdatabase "github.com/maxsupermanhd/go-wz/maps-database"
+)
+
+// mapWhitelistHostCategory is the first season of category rated host requests count towards,
+// requests go to its current successor
+const mapWhitelistHostCategory = 3
+
+func GetHostCategory(ctx context.Context) (int, error) {
+	return seasonCurrent(ctx, mapWhitelistHostCategory)
+}
+
+type MapWhitelistEntry struct {
+	Hash      string
+	Category  int
+	Name      string
+	Players   int
+	Note      string `json:",omitempty"`
+	Balance   map[string]any
+	Balanced  bool
+	AddedBy   string `json:",omitempty"`
+	TimeAdded time.Time
+}
+
+// mapInfoBalanced checks that every player starts with the same units and structures
+func mapInfoBalanced(inf *mapsdatabase.MapInfo) bool {
+	p := inf.Player
+	return p.Units.Eq && p.Structs.Eq && p.ResourceExtr.Eq && p.PwrGen.Eq && p.RegFact.Eq &&
+		p.VtolFact.Eq && p.CyborgFact.Eq && p.ResearchCent.Eq && p.DefStruct.Eq
+}
+
+func GetMapWhitelist(ctx context.Context, category int) ([]*MapWhitelistEntry, error) {
+	r := []*MapWhitelistEntry{}
+	cond := ""
+	args := []any{}
+	if category > 0 {
+		cond = "where category = $1"
+		args = append(args, category)
+	}
+	return r, pgxscan.Select(ctx, dbpool, &r, `select * from map_whitelist `+cond+` order by category, name`, args...)
+}
+
+// configMapWhitelist reads whitelistedMaps from config, host category falls back to it
+// until maps are added or imported into it so rated hosting works right after deploy
+func configMapWhitelist() []*MapWhitelistEntry {
+	ret := []*MapWhitelistEntry{}
+	whitelistedMaps, ok := cfg.GetMapStringAny("whitelistedMaps")
+	if !ok {
+		return ret
+	}
+	for name, v := range whitelistedMaps {
+		vv, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		h, ok := vv["Hash"].(string)
+		if !ok {
+			continue
+		}
+		players, _ := vv["Players"].(float64)
+		ret = append(ret, &MapWhitelistEntry{Hash: h, Name: name, Players: int(players), Note: "from config"})
+	}
+	return ret
+}
+
+func mapWhitelistMigrated(ctx context.Context) (bool, error) {
+	var migrated bool
+	err := dbpool.QueryRow(ctx, `select exists(select 1 from map_whitelist_migrated)`).Scan(&migrated)
+	return migrated, err
+}
+
+func mapWhitelistMarkMigrated(ctx context.Context, username string) error {
+	_, err := dbpool.Exec(ctx, `insert into map_whitelist_migrated (migrated_by) values ($1) on conflict do nothing`, username)
+	return err
+}
+
+// GetHostMapWhitelist lists maps allowed for rated host requests
+func GetHostMapWhitelist(ctx context.Context, category int) ([]*MapWhitelistEntry, error) {
+	migrated, err := mapWhitelistMigrated(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if migrated {
+		return GetMapWhitelist(ctx, category)
+	}
+	r := configMapWhitelist()
+	for _, m := range r {
+		m.Category = category
+	}
+	return r, nil
+}
+
+func isHostMapWhitelisted(ctx context.Context, hash string, category int) (bool, error) {
+	whitelist, err := GetHostMapWhitelist(ctx, category)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range whitelist {
+		if strings.EqualFold(m.Hash, hash) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// addMapWhitelist fetches map from maps database and stores it along with balance check results
+func addMapWhitelist(ctx context.Context, hash string, category int, note string, addedBy string) (*mapsdatabase.MapInfo, error) {
+	inf, err := mapsdatabase.FetchMapInfo(hash)
+	if err != nil {
+		return nil, err
+	}
+	_, err = dbpool.Exec(ctx, `insert into map_whitelist (hash, category, name, players, note, balance, balanced, added_by) values ($1, $2, $3, $4, $5, $6, $7, $8)
+on conflict (hash, category) do update set name = excluded.name, players = excluded.players, note = excluded.note,
+	balance = excluded.balance, balanced = excluded.balanced, added_by = excluded.added_by, time_added = now()`,
+		inf.Download.Hash, category, inf.Name, inf.Slots, note, inf.Player, mapInfoBalanced(inf), addedBy)
+	return inf, err
+}
+
+func modMapWhitelistHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := GetMapWhitelist(r.Context(), 0)
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	cats, err := GetRatingCategories(r.Context(), dbpool)
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	hostCategory, err := GetHostCategory(r.Context())
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	migrated, err := mapWhitelistMigrated(r.Context())
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	_, configured := cfg.GetMapStringAny("whitelistedMaps")
+	basicLayoutLookupRespond("modMapWhitelist", w, r, map[string]any{
+		"Entries":         entries,
+		"Categories":      cats,
+		"ConfigWhitelist": configured,
+		"Migrated":        migrated,
+		"HostCategory":    hostCategory,
+	})
+}
+
+// modMapWhitelistPOST adds, removes or imports whitelistedMaps from config into host category
+func modMapWhitelistPOST(w http.ResponseWriter, r *http.Request) {
+	if !checkFormParse(w, r) {
+		return
+	}
+	username := sessionGetUsername(r)
+	var msg string
+	switch r.FormValue("action") {
+	case "add":
+		hash := strings.TrimSpace(r.FormValue("hash"))
+		category := parseFormInt(r, "category")
+		if hash == "" || category == nil {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Hash and category are required"})
+			return
+		}
+		note := strings.TrimSpace(r.FormValue("note"))
+		inf, err := addMapWhitelist(r.Context(), hash, *category, note, username)
+		if err != nil {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Failed to add map: " + err.Error()})
+			return
+		}
+		hostCategory, err := GetHostCategory(r.Context())
+		if err == nil && hostCategory == *category {
+			err = mapWhitelistMarkMigrated(r.Context(), username)
+		}
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+			return
+		}
+		msg = fmt.Sprintf("Administrator `%s` whitelisted map `%s` (`%s`) for category `%d`", username, inf.Name, inf.Download.Hash, *category)
+		if !mapInfoBalanced(inf) {
+			msg += " despite failed balance check"
+		}
+	case "remove":
+		hash := r.FormValue("hash")
+		category := parseFormInt(r, "category")
+		if category == nil {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Category is missing"})
+			return
+		}
+		tag, err := dbpool.Exec(r.Context(), `delete from map_whitelist where hash = $1 and category = $2`, hash, *category)
+		if err != nil {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Map is not whitelisted in this category"})
+			return
+		}
+		msg = fmt.Sprintf("Administrator `%s` removed map `%s` from whitelist of category `%d`", username, hash, *category)
+	case "import":
+		_, ok := cfg.GetMapStringAny("whitelistedMaps")
+		if !ok {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "whitelistedMaps is not set in config"})
+			return
+		}
+		hostCategory, err := GetHostCategory(r.Context())
+		if err != nil {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Failed to find current host category: " + err.Error()})
+			return
+		}
+		imported := 0
+		failed := []string{}
+		for _, m := range configMapWhitelist() {
+			_, err := addMapWhitelist(r.Context(), m.Hash, hostCategory, "imported from config", username)
+			if err != nil {
+				log.Printf("Failed to import whitelisted map %q: %s", m.Name, err.Error())
+				failed = append(failed, m.Name)
+				continue
+			}
+			imported++
+		}
+		err = mapWhitelistMarkMigrated(r.Context(), username)
+		if err != nil {
+			basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+			return
+		}
+		msg = fmt.Sprintf("Administrator `%s` imported %d whitelisted maps from config into category `%d`", username, imported, hostCategory)
+		if len(failed) > 0 {
+			msg += fmt.Sprintf(", failed: %s", strings.Join(failed, ", "))
+		}
+	default:
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Unknown action"})
+		return
+	}
+	err := modSendWebhook(msg)
+	if err != nil {
+		log.Println(err)
+	}
+	w.Header().Set("Refresh", "1; /moderation/mapWhitelist")
+	basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msggreen": true, "msg": "Done"})
+}
+
+// APIgetMapWhitelist lists maps of category, current host category by default,
+// who added maps and notes are only shown to moderators
+func APIgetMapWhitelist(_ http.ResponseWriter, r *http.Request) (int, any) {
+	hostCategory, err := GetHostCategory(r.Context())
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return 500, err
+	}
+	category := hostCategory
+	if v := r.URL.Query().Get("category"); v != "" {
+		category, err = strconv.Atoi(v)
+		if err != nil {
+			return 400, nil
+		}
+	} else if hostCategory == 0 {
+		return 200, []*MapWhitelistEntry{}
+	}
+	var entries []*MapWhitelistEntry
+	if category == hostCategory {
+		entries, err = GetHostMapWhitelist(r.Context(), category)
+	} else {
+		entries, err = GetMapWhitelist(r.Context(), category)
+	}
+	if err != nil {
+		return 500, err
+	}
+	if !isSuperadmin(r.Context(), sessionGetUsername(r)) {
+		for _, e := range entries {
+			e.AddedBy = ""
+			e.Note = ""
+		}
+	}
+	return 200, entries
+}
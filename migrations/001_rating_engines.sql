@@ -0,0 +1,33 @@
+-- per-category rating engine selection and parameters
+alter table rating_categories add column if not exists engine text not null default 'elo';
+alter table rating_categories add column if not exists params jsonb not null default '{}'::jsonb;
+
+-- engine specific state, elo column stays as displayed rating
+alter table rating add column if not exists mu double precision not null default 0;
+alter table rating add column if not exists sigma double precision not null default 0;
+alter table rating add column if not exists volatility double precision not null default 0;
+
+-- games that count towards rating category
+create table if not exists games_rating_categories (
+	game bigint not null references games(id),
+	category int not null references rating_categories(id),
+	primary key (game, category)
+);
+
+-- rating of account in category right after the game was calculated
+create table if not exists games_rating_diff (
+	game bigint not null references games(id),
+	category int not null references rating_categories(id),
+	account int not null references accounts(id),
+	diff int not null,
+	elo int not null,
+	mu double precision not null,
+	sigma double precision not null,
+	volatility double precision not null,
+	played int not null,
+	won int not null,
+	lost int not null,
+	time_played int not null,
+	primary key (game, category, account)
+);
+create index if not exists games_rating_diff_account on games_rating_diff (category, account, game);
@@ -0,0 +1,14 @@
+-- background rating recalculation jobs, last_game is the checkpoint
+create table if not exists rating_recalc_jobs (
+	id serial primary key,
+	category int not null references rating_categories(id),
+	from_game bigint not null default 0,
+	last_game bigint,
+	total int not null default 0,
+	processed int not null default 0,
+	status text not null default 'queued',
+	error text,
+	started_by text,
+	time_started timestamp not null default now(),
+	time_updated timestamp not null default now()
+);
@@ -0,0 +1,7 @@
+-- structured rating calculation log, one per game in each category it was processed for
+create table if not exists games_rating_log (
+	game bigint not null references games(id),
+	category int not null references rating_categories(id),
+	log jsonb not null,
+	primary key (game, category)
+);
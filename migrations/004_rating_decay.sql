@@ -0,0 +1,11 @@
+-- inactivity tracking for rating decay
+alter table rating add column if not exists time_last_played timestamp;
+alter table rating add column if not exists time_decayed timestamp;
+alter table games_rating_diff add column if not exists time_last_played timestamp;
+alter table games_rating_diff add column if not exists time_decayed timestamp;
+update rating as r set time_last_played = (
+	select max(g.time_started)
+	from games_rating_diff as d
+	join games as g on g.id = d.game
+	where d.category = r.category and d.account = r.account
+) where r.time_last_played is null;
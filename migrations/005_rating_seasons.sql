@@ -0,0 +1,29 @@
+-- seasons: finished categories get archived, successor links back to predecessor
+alter table rating_categories add column if not exists archived boolean not null default false;
+alter table rating_categories add column if not exists predecessor int references rating_categories(id);
+
+-- final standings of finished categories
+create table if not exists rating_archive (
+	category int not null references rating_categories(id),
+	account int not null references accounts(id),
+	rank int not null,
+	display_name text not null,
+	elo int not null,
+	played int not null,
+	won int not null,
+	lost int not null,
+	time_played int not null,
+	primary key (category, account)
+);
+create index if not exists rating_archive_account on rating_archive (account);
+
+-- starting ratings of successor category (soft reset), used instead of initial rating
+create table if not exists rating_seed (
+	category int not null references rating_categories(id),
+	account int not null references accounts(id),
+	elo int not null,
+	mu double precision not null,
+	sigma double precision not null,
+	volatility double precision not null,
+	primary key (category, account)
+);
@@ -0,0 +1,7 @@
+-- rating lookup (in-game badges) rules, single row, built-in defaults are used when missing
+create table if not exists rating_lookup_config (
+	id int primary key default 1 check (id = 1),
+	config jsonb not null,
+	updated_by text,
+	time_updated timestamp not null default now()
+);
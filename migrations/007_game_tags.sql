@@ -0,0 +1,11 @@
+-- user tags and notes attached to games, locked tags can only be changed by moderators
+create table if not exists game_tags (
+	game bigint not null references games(id) on delete cascade,
+	tag text not null,
+	note text not null default '',
+	account int not null references accounts(id),
+	locked bool not null default false,
+	time_added timestamp not null default now(),
+	primary key (game, tag)
+);
+create index if not exists game_tags_tag on game_tags (tag);
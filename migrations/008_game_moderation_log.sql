@@ -0,0 +1,11 @@
+-- audit trail of moderator actions on games
+create table if not exists game_moderation_log (
+	id serial primary key,
+	game bigint not null references games(id) on delete cascade,
+	action text not null,
+	reason text not null default '',
+	moderator text not null,
+	recalc_jobs int[] not null default '{}',
+	time_done timestamp not null default now()
+);
+create index if not exists game_moderation_log_game on game_moderation_log (game);
@@ -0,0 +1,19 @@
+-- suspicious rating activity found by abuse detector, key deduplicates repeated detections
+create table if not exists rating_abuse_flags (
+	id serial primary key,
+	key text not null unique,
+	kind text not null,
+	accounts int[] not null,
+	games bigint[] not null default '{}',
+	details text not null default '',
+	status text not null default 'open',
+	reviewed_by text,
+	review_note text not null default '',
+	time_flagged timestamp not null default now(),
+	time_updated timestamp not null default now(),
+	time_reviewed timestamp
+);
+create index if not exists rating_abuse_flags_status on rating_abuse_flags (status);
+
+-- shared identity name detection compares names case insensitively
+create index if not exists identities_lower_name on identities (lower(name));
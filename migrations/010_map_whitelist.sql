@@ -0,0 +1,13 @@
+-- maps allowed in rated host requests, balance holds maps database player balance check at the time of adding
+create table if not exists map_whitelist (
+	hash text not null,
+	category int not null references rating_categories(id),
+	name text not null,
+	players int not null,
+	note text not null default '',
+	balance jsonb not null default '{}'::jsonb,
+	balanced boolean not null,
+	added_by text not null,
+	time_added timestamp not null default now(),
+	primary key (hash, category)
+);
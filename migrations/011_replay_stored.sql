@@ -0,0 +1,2 @@
+-- name of replay storage backend holding replay that was moved out of games.replay column
+alter table games add column if not exists replay_stored text;
@@ -0,0 +1,55 @@
+-- replays parsed once into events, replay_ingest marks processed games,
+-- seq keeps packet order of events within the replay
+create table if not exists replay_ingest (
+	game bigint primary key references games(id) on delete cascade,
+	status text not null,
+	error text,
+	max_players int not null default 0,
+	game_time_elapsed int not null default 0,
+	positions int[] not null default '{}',
+	colours int[] not null default '{}',
+	events int not null default 0,
+	time_ingested timestamp not null default now()
+);
+
+-- droid orders given by players, secondary orders have no coordinates
+create table if not exists replay_droid_orders (
+	game bigint not null references games(id) on delete cascade,
+	seq int not null,
+	game_time int not null,
+	player smallint not null,
+	sub_type smallint not null,
+	droid_order int not null,
+	sec_order int not null,
+	x int not null,
+	y int not null,
+	droids_count int not null,
+	droids_checksum smallint not null
+);
+create index if not exists replay_droid_orders_game on replay_droid_orders (game, seq);
+
+create table if not exists replay_research (
+	game bigint not null references games(id) on delete cascade,
+	seq int not null,
+	game_time int not null,
+	player smallint not null,
+	start boolean not null,
+	building bigint not null,
+	topic bigint not null
+);
+create index if not exists replay_research_game on replay_research (game, seq);
+
+-- build and line build orders, struct_ref is structure stats reference
+create table if not exists replay_structure_builds (
+	game bigint not null references games(id) on delete cascade,
+	seq int not null,
+	game_time int not null,
+	player smallint not null,
+	struct_ref bigint not null,
+	x int not null,
+	y int not null,
+	x2 int not null,
+	y2 int not null,
+	direction int not null
+);
+create index if not exists replay_structure_builds_game on replay_structure_builds (game, seq);
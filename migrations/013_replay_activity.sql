@@ -0,0 +1,23 @@
+-- rows ingested with older version are picked up by ingestion runner again
+alter table replay_ingest add column if not exists version int not null default 1;
+
+-- object orders carry target id instead of coordinates
+alter table replay_droid_orders add column if not exists dest_id bigint not null default 0;
+
+-- per player command counts of a game, game_time is in milliseconds,
+-- apm and epm are per minute of game time
+create table if not exists replay_activity (
+	game bigint not null references games(id) on delete cascade,
+	player smallint not null,
+	position smallint not null,
+	game_time int not null,
+	orders int not null,
+	unique_orders int not null,
+	selection_changes int not null,
+	research int not null,
+	builds int not null,
+	apm real not null,
+	epm real not null,
+	primary key (game, player)
+);
+create index if not exists replay_activity_game_position on replay_activity (game, position);
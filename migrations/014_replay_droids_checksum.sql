@@ -0,0 +1,2 @@
+-- selection checksum is 64 bit hash of droid ids now, version 3 ingestion refills it
+alter table replay_droid_orders alter column droids_checksum type bigint;
@@ -0,0 +1,8 @@
+-- single row, present once host category whitelist was filled from moderation page,
+-- until then host requests use whitelistedMaps from config
+create table if not exists map_whitelist_migrated (
+	id int primary key default 1 check (id = 1),
+	migrated_by text not null,
+	time_migrated timestamp not null default now()
+);
+insert into map_whitelist_migrated (migrated_by) select 'migration' where exists(select 1 from map_whitelist) on conflict do nothing;
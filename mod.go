@@ -77,6 +77,7 @@ func APIgetAccounts2(_ http.ResponseWriter, r *http.Request) (int, any) {
 		Identities       string     `json:"identities"`
 	}](r, genericRequestParams{
 		tableName:               "accounts_view",
+		cursorKey:               "id",
 		limitClamp:              1500,
 		sortDefaultOrder:        "desc",
 		sortDefaultColumn:       "id",
@@ -138,6 +139,7 @@ func modAccountsPOST(w http.ResponseWriter, r *http.Request) {
 		logRespondWithCodeAndPlaintext(w, 500, "Sus result "+tag.String())
 		return
 	}
+	ratingLookupCacheInvalidateUsername(r.Context(), r.FormValue("name"))
 	w.WriteHeader(200)
 	err = modSendWebhook(fmt.Sprintf("Administrator `%s` changed `%s` to `%s` for user `%s`.", sessionGetUsername(r), r.FormValue("param"), r.FormValue("val"), r.FormValue("name")))
 	if err != nil {
@@ -236,6 +238,7 @@ func APIgetLogs2(_ http.ResponseWriter, r *http.Request) (int, any) {
 		Msg      string    `json:"msg"`
 	}](r, genericRequestParams{
 		tableName:               "composelog",
+		cursorKey:               "id",
 		limitClamp:              1500,
 		sortDefaultOrder:        "desc",
 		sortDefaultColumn:       "whensent",
@@ -264,6 +267,7 @@ func APIgetIdentities(_ http.ResponseWriter, r *http.Request) (int, any) {
 		Account *int
 	}](r, genericRequestParams{
 		tableName:               "identities_view",
+		cursorKey:               "id",
 		limitClamp:              500,
 		sortDefaultOrder:        "desc",
 		sortDefaultColumn:       "id",
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// pageCursor points right after the last row of previous page,
+// it is only valid for the same sort column and order
+type pageCursor struct {
+	Sort  string  `json:"s"`
+	Order string  `json:"o"`
+	Value *string `json:"v"`
+	Key   string  `json:"k"`
+}
+
+var errBadCursor = errors.New("malformed or mismatching cursor")
+
+func (c *pageCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parsePageCursor reads cursor query parameter, returns nil if it is not present
+func parsePageCursor(r *http.Request, sort, order string) (*pageCursor, error) {
+	v := parseQueryString(r, "cursor", "")
+	if v == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	c := &pageCursor{}
+	err = json.Unmarshal(b, c)
+	if err != nil || c.Sort != sort || c.Order != order {
+		return nil, errBadCursor
+	}
+	return c, nil
+}
+
+// keysetCondition selects rows after the cursor when ordered by (sortColumn, keyColumn),
+// postgres puts nulls last in ascending order and first in descending
+func keysetCondition(sortColumn, keyColumn string, c *pageCursor, args *[]any) string {
+	arg := func(v any) string {
+		*args = append(*args, v)
+		return "$" + strconv.Itoa(len(*args))
+	}
+	cmp := ">"
+	if c.Order == "desc" {
+		cmp = "<"
+	}
+	k := arg(c.Key)
+	if sortColumn == keyColumn {
+		return keyColumn + " " + cmp + " " + k
+	}
+	if c.Value == nil {
+		if c.Order == "desc" {
+			return "((" + sortColumn + " is null and " + keyColumn + " " + cmp + " " + k + ") or " + sortColumn + " is not null)"
+		}
+		return "(" + sortColumn + " is null and " + keyColumn + " " + cmp + " " + k + ")"
+	}
+	v := arg(*c.Value)
+	ret := "(" + sortColumn + " " + cmp + " " + v + " or (" + sortColumn + " = " + v + " and " + keyColumn + " " + cmp + " " + k + ")"
+	if c.Order == "asc" {
+		ret += " or " + sortColumn + " is null"
+	}
+	return ret + ")"
+}
+
+// parseTotalsMode tells how row counts should be calculated: exact, approx or none,
+// cursor requests skip counting unless asked since they are used for deep browsing
+func parseTotalsMode(r *http.Request, cursor bool) string {
+	if cursor {
+		return parseQueryStringFiltered(r, "totals", "none", "exact", "approx")
+	}
+	return parseQueryStringFiltered(r, "totals", "exact", "approx", "none")
+}
+
+// countRows counts rows returned by query, approx mode uses planner estimate
+func countRows(ctx context.Context, mode string, query string, args ...any) (int, error) {
+	var c int
+	switch mode {
+	case "exact":
+		return c, dbpool.QueryRow(ctx, `select count(*) from (`+query+`) as counted`, args...).Scan(&c)
+	case "approx":
+		var plan []struct {
+			Plan struct {
+				Rows float64 `json:"Plan Rows"`
+			}
+		}
+		err := dbpool.QueryRow(ctx, `explain (format json) `+query, args...).Scan(&plan)
+		if err != nil {
+			return c, err
+		}
+		if len(plan) > 0 {
+			c = int(plan[0].Plan.Rows)
+		}
+	}
+	return c, nil
+}
+
+// addTotals puts counts into list response unless they were not requested
+func addTotals(ret map[string]any, mode string, total, totalNotFiltered int) {
+	if mode == "none" {
+		return
+	}
+	ret["total"] = total
+	ret["totalNotFiltered"] = totalNotFiltered
+	if mode == "approx" {
+		ret["totalApprox"] = true
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/georgysavva/scany/pgxscan"
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v4"
 )
@@ -28,6 +30,34 @@ type PlayerLeaderboard struct {
 	LastGame   int     `json:",omitempty"`
 }
 
+type RatingHistoryEntry struct {
+	Game        int
+	TimeStarted time.Time
+	Rating      int
+	Diff        int
+}
+
+func APIgetPlayerRatingHistory(_ http.ResponseWriter, r *http.Request) (int, any) {
+	identSpecifier, err := hex.DecodeString(mux.Vars(r)["identity"])
+	if err != nil {
+		return 400, err
+	}
+	category := parseQueryInt(r, "category", 0)
+	if category <= 0 {
+		return 400, errors.New("category is required")
+	}
+	ret := []*RatingHistoryEntry{}
+	err = pgxscan.Select(r.Context(), dbpool, &ret, `select d.game, g.time_started, d.elo as rating, d.diff
+from games_rating_diff as d
+join games as g on g.id = d.game
+where d.category = $1 and d.account = (select account from identities where pkey = $2 or hash ^@ encode($2, 'hex') limit 1)
+order by d.game`, category, identSpecifier)
+	if err != nil {
+		return 500, err
+	}
+	return 200, ret
+}
+
 func PlayersHandler(w http.ResponseWriter, r *http.Request) {
 	identSpecifier, err := hex.DecodeString(mux.Vars(r)["id"])
 	if err != nil {
@@ -50,12 +80,28 @@ func PlayersHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	ratingCategories := []*RatingCategory{}
+	err = pgxscan.Select(r.Context(), dbpool, &ratingCategories, `select c.*
+from rating_categories as c
+join rating as r on r.category = c.id
+join identities as i on i.account = r.account
+where i.id = $1
+order by c.id desc`, identID)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Println(err)
+	}
+	activity, err := GetPlayerActivity(r.Context(), identID)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Println(err)
+	}
 	basicLayoutLookupRespond("player", w, r, map[string]any{
 		"Player": map[string]any{
 			"Name":           identName,
 			"IdentityPubKey": identPubKey,
 			"IdentityHash":   identHash,
 		},
+		"RatingCategories": ratingCategories,
+		"Activity":         activity,
 	})
 
 	// var pp PlayerLeaderboard
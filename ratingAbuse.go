@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+type RatingAbuseFlag struct {
+	ID           int
+	Key          string
+	Kind         string
+	Accounts     []int
+	Games        []int
+	Details      string
+	Status       string
+	ReviewedBy   *string
+	ReviewNote   string
+	TimeFlagged  time.Time
+	TimeUpdated  time.Time
+	TimeReviewed *time.Time
+}
+
+var ratingAbuseScanWakeup = make(chan struct{}, 1)
+
+// ratingAbuseRunner periodically scans recent calculated games, scan can also be requested from moderation page
+func ratingAbuseRunner() {
+	for {
+		if !isEloRecalculating.Load() {
+			err := ratingAbuseScan(context.Background())
+			if err != nil {
+				log.Printf("Failed to scan for rating abuse: %s", err.Error())
+			}
+		}
+		select {
+		case <-ratingAbuseScanWakeup:
+		case <-time.After(time.Duration(cfg.GetDInt(360, "ratingAbuseIntervalMinutes")) * time.Minute):
+		}
+	}
+}
+
+func ratingAbuseScan(ctx context.Context) error {
+	flags := []*RatingAbuseFlag{}
+	for _, detect := range []func(context.Context, int) ([]*RatingAbuseFlag, error){
+		ratingAbuseDetectPairings,
+		ratingAbuseDetectShortGames,
+		ratingAbuseDetectSharedIdentities,
+	} {
+		f, err := detect(ctx, cfg.GetDInt(30, "ratingAbuseScanDays"))
+		if err != nil {
+			return err
+		}
+		flags = append(flags, f...)
+	}
+	created := []*RatingAbuseFlag{}
+	for _, f := range flags {
+		isNew, err := ratingAbuseFlagSave(ctx, f)
+		if err != nil {
+			return err
+		}
+		if isNew {
+			created = append(created, f)
+		}
+	}
+	if len(created) == 0 {
+		return nil
+	}
+	log.Printf("Rating abuse scan flagged %d new cases", len(created))
+	msg := fmt.Sprintf("Rating abuse detector flagged %d new cases for review:", len(created))
+	for i, f := range created {
+		if i == 10 {
+			msg += fmt.Sprintf("\n... and %d more", len(created)-i)
+			break
+		}
+		msg += fmt.Sprintf("\n`%d` %s: %s", f.ID, f.Kind, f.Details)
+	}
+	return modSendWebhook(msg)
+}
+
+// ratingAbuseFlagSave stores new flag or refreshes evidence of the open one,
+// reviewed flags are left alone
+func ratingAbuseFlagSave(ctx context.Context, f *RatingAbuseFlag) (bool, error) {
+	var isNew bool
+	err := dbpool.QueryRow(ctx, `insert into rating_abuse_flags (key, kind, accounts, games, details) values ($1, $2, $3, $4, $5)
+on conflict (key) do update set games = excluded.games, details = excluded.details, time_updated = now()
+	where rating_abuse_flags.status = 'open' and rating_abuse_flags.games != excluded.games
+returning id, xmax = 0`, f.Key, f.Kind, f.Accounts, f.Games, f.Details).Scan(&f.ID, &isNew)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return isNew, err
+}
+
+func ratingAbuseKey(kind string, accounts ...int) string {
+	s := make([]string, len(accounts))
+	for i, a := range accounts {
+		s[i] = strconv.Itoa(a)
+	}
+	return kind + ":" + strings.Join(s, ",")
+}
+
+// ratingAbuseDetectPairings flags pairs of opponents that keep playing each other
+// with winner switching nearly every game
+func ratingAbuseDetectPairings(ctx context.Context, days int) ([]*RatingAbuseFlag, error) {
+	ret := []*RatingAbuseFlag{}
+	minGames := cfg.GetDInt(6, "ratingAbusePairingMinGames")
+	minAlternation := cfg.GetDFloat64(0.8, "ratingAbusePairingAlternation")
+	var (
+		a, b  int
+		games []int
+		aWon  []bool
+	)
+	_, err := dbpool.QueryFunc(ctx, `select ia.account, ib.account, array_agg(g.id order by g.time_started), array_agg(pa.usertype = 'winner' order by g.time_started)
+from games as g
+join players as pa on pa.game = g.id
+join identities as ia on ia.id = pa.identity
+join players as pb on pb.game = g.id and pb.team != pa.team
+join identities as ib on ib.id = pb.identity
+where g.calculated = true and g.deleted = false and g.time_started > now() - make_interval(days => $1)
+	and ia.account < ib.account
+	and pa.usertype = any('{winner,loser}') and pb.usertype = any('{winner,loser}') and pa.usertype != pb.usertype
+group by ia.account, ib.account
+having count(distinct g.id) >= $2`, []any{days, minGames}, []any{&a, &b, &games, &aWon},
+		func(_ pgx.QueryFuncRow) error {
+			switches := 0
+			for i := 1; i < len(aWon); i++ {
+				if aWon[i] != aWon[i-1] {
+					switches++
+				}
+			}
+			alternation := float64(switches) / float64(len(aWon)-1)
+			if alternation < minAlternation {
+				return nil
+			}
+			ret = append(ret, &RatingAbuseFlag{
+				Key:      ratingAbuseKey("pairing", a, b),
+				Kind:     "pairing",
+				Accounts: []int{a, b},
+				Games:    append([]int{}, games...),
+				Details:  fmt.Sprintf("accounts %d and %d played %d games against each other, winner switched %d times", a, b, len(games), switches),
+			})
+			return nil
+		})
+	return ret, err
+}
+
+// ratingAbuseDetectShortGames flags opponents with several rated games that ended
+// shortly after the 2 minute cutoff of CalcElo
+func ratingAbuseDetectShortGames(ctx context.Context, days int) ([]*RatingAbuseFlag, error) {
+	ret := []*RatingAbuseFlag{}
+	maxTime := cfg.GetDInt(300, "ratingAbuseShortGameSeconds") * 1000
+	minGames := cfg.GetDInt(3, "ratingAbuseShortGamesMin")
+	var (
+		winner, loser int
+		games         []int
+	)
+	_, err := dbpool.QueryFunc(ctx, `select iw.account, il.account, array_agg(distinct g.id)
+from games as g
+join players as pw on pw.game = g.id and pw.usertype = 'winner'
+join identities as iw on iw.id = pw.identity
+join players as pl on pl.game = g.id and pl.usertype = 'loser'
+join identities as il on il.id = pl.identity
+where g.calculated = true and g.deleted = false and g.time_started > now() - make_interval(days => $1)
+	and g.game_time >= 120000 and g.game_time < $2
+	and iw.account is not null and il.account is not null
+group by iw.account, il.account
+having count(distinct g.id) >= $3`, []any{days, maxTime, minGames}, []any{&winner, &loser, &games},
+		func(_ pgx.QueryFuncRow) error {
+			ret = append(ret, &RatingAbuseFlag{
+				Key:      ratingAbuseKey("short", winner, loser),
+				Kind:     "short",
+				Accounts: []int{winner, loser},
+				Games:    append([]int{}, games...),
+				Details:  fmt.Sprintf("account %d won %d games shorter than %d seconds against account %d", winner, len(games), maxTime/1000, loser),
+			})
+			return nil
+		})
+	return ret, err
+}
+
+// ratingAbuseDetectSharedIdentities flags accounts that played rated games against each other
+// with identities of the same name, only identities that played in the window are compared
+func ratingAbuseDetectSharedIdentities(ctx context.Context, days int) ([]*RatingAbuseFlag, error) {
+	ret := []*RatingAbuseFlag{}
+	var (
+		a, b  int
+		name  string
+		games []int
+	)
+	_, err := dbpool.QueryFunc(ctx, `with active as materialized (
+	select distinct i.account, i.name, lower(i.name) as lname
+	from games as g
+	join players as p on p.game = g.id
+	join identities as i on i.id = p.identity
+	where g.calculated = true and g.deleted = false and g.time_started > now() - make_interval(days => $1)
+		and i.account is not null and i.name != ''
+), pairs as (
+	select sa.account as a, sb.account as b, min(sa.name) as name
+	from active as sa
+	join active as sb on sb.lname = sa.lname and sb.account > sa.account
+	group by sa.account, sb.account
+)
+select pairs.a, pairs.b, pairs.name, coalesce((select array_agg(distinct g.id)
+	from games as g
+	join players as pa on pa.game = g.id
+	join identities as ia on ia.id = pa.identity and ia.account = pairs.a
+	join players as pb on pb.game = g.id and pb.team != pa.team
+	join identities as ib on ib.id = pb.identity and ib.account = pairs.b
+	where g.calculated = true and g.deleted = false and g.time_started > now() - make_interval(days => $1)), '{}')
+from pairs`, []any{days}, []any{&a, &b, &name, &games},
+		func(_ pgx.QueryFuncRow) error {
+			if len(games) == 0 {
+				return nil
+			}
+			ret = append(ret, &RatingAbuseFlag{
+				Key:      ratingAbuseKey("shared", a, b),
+				Kind:     "shared",
+				Accounts: []int{a, b},
+				Games:    append([]int{}, games...),
+				Details:  fmt.Sprintf("accounts %d and %d both use identity name %q and played %d rated games against each other", a, b, name, len(games)),
+			})
+			return nil
+		})
+	return ret, err
+}
+
+func APIgetRatingAbuseFlags(_ http.ResponseWriter, r *http.Request) (int, any) {
+	return genericViewRequest[RatingAbuseFlag](r, genericRequestParams{
+		tableName:         "rating_abuse_flags",
+		cursorKey:         "id",
+		limitClamp:        500,
+		sortDefaultOrder:  "desc",
+		sortDefaultColumn: "id",
+		sortColumns:       []string{"ID", "TimeFlagged", "TimeUpdated"},
+		filterColumnsFull: []string{"id", "kind", "status"},
+		columnMappings: map[string]string{
+			"ID":          "id",
+			"Kind":        "kind",
+			"Status":      "status",
+			"TimeFlagged": "time_flagged",
+			"TimeUpdated": "time_updated",
+		},
+	})
+}
+
+// modRatingAbusePOST confirms, dismisses or reopens flags and requests scan
+func modRatingAbusePOST(w http.ResponseWriter, r *http.Request) {
+	if !checkFormParse(w, r) {
+		return
+	}
+	username := sessionGetUsername(r)
+	action := r.FormValue("action")
+	if action == "scan" {
+		select {
+		case ratingAbuseScanWakeup <- struct{}{}:
+		default:
+		}
+		w.Header().Set("Refresh", "1; /moderation/ratingAbuse")
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msggreen": true, "msg": "Scan requested"})
+		return
+	}
+	status, ok := map[string]string{"confirm": "confirmed", "dismiss": "dismissed", "reopen": "open"}[action]
+	if !ok {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Unknown action"})
+		return
+	}
+	id := parseFormInt(r, "id")
+	if id == nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Flag id is missing"})
+		return
+	}
+	note := strings.TrimSpace(r.FormValue("note"))
+	tag, err := dbpool.Exec(r.Context(), `update rating_abuse_flags set status = $2, review_note = $3, reviewed_by = $4, time_reviewed = now() where id = $1`,
+		*id, status, note, username)
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Flag not found"})
+		return
+	}
+	msg := fmt.Sprintf("Administrator `%s` marked rating abuse flag `%d` as %s", username, *id, status)
+	if note != "" {
+		msg += fmt.Sprintf(" (note: %q)", note)
+	}
+	err = modSendWebhook(msg)
+	if err != nil {
+		log.Println(err)
+	}
+	w.Header().Set("Refresh", "1; /moderation/ratingAbuse")
+	basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msggreen": true, "msg": "Flag " + strconv.Itoa(*id) + " " + status})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ratingDecayRunner periodically applies inactivity decay to categories that have it configured
+func ratingDecayRunner() {
+	for {
+		if ratingWriteLock.TryLock() {
+			err := ratingDecayAll(context.Background())
+			ratingWriteLock.Unlock()
+			if err != nil {
+				log.Printf("Failed to apply rating decay: %s", err.Error())
+			}
+		}
+		time.Sleep(time.Duration(cfg.GetDInt(60, "ratingDecayIntervalMinutes")) * time.Minute)
+	}
+}
+
+func ratingDecayAll(ctx context.Context) error {
+	cats, err := GetRatingCategories(ctx, dbpool)
+	if err != nil {
+		return err
+	}
+	now := int(time.Now().Unix())
+	for _, c := range cats {
+		if c.Archived || c.Params.InactiveDays <= 0 {
+			continue
+		}
+		n, err := ratingDecayCategory(ctx, c, now)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("Decayed rating of %d accounts in category %d", n, c.ID)
+		}
+	}
+	return nil
+}
+
+func ratingDecayCategory(ctx context.Context, c *RatingCategory, now int) (int, error) {
+	rs, err := NewRatingSystem(c)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := dbpool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	b := pgx.Batch{}
+	decayed := []int{}
+	var e Elo
+	_, err = tx.QueryFunc(ctx, `select account, elo, mu, sigma, volatility,
+	extract(epoch from time_last_played)::int, coalesce(extract(epoch from time_decayed)::int, 0)
+from rating
+where category = $1 and time_last_played < to_timestamp($2::int) - make_interval(secs => $3::float8 * 86400)
+for update`, []any{c.ID, now, c.Params.InactiveDays},
+		[]any{&e.Account, &e.Elo, &e.Mu, &e.Sigma, &e.Volatility, &e.LastPlayed, &e.TimeDecayed},
+		func(_ pgx.QueryFuncRow) error {
+			before := e
+			rs.Decay(&e, now)
+			if e == before {
+				return nil
+			}
+			decayed = append(decayed, e.Account)
+			b.Queue(`update rating set elo = $3, mu = $4, sigma = $5, time_decayed = to_timestamp($6::int) where category = $1 and account = $2`,
+				c.ID, e.Account, e.Elo, e.Mu, e.Sigma, e.TimeDecayed)
+			return nil
+		})
+	if err != nil {
+		return 0, err
+	}
+	n := b.Len()
+	if n == 0 {
+		return 0, nil
+	}
+	br := tx.SendBatch(ctx, &b)
+	for i := 0; i < n; i++ {
+		_, err = br.Exec()
+		if err != nil {
+			br.Close()
+			return 0, err
+		}
+	}
+	err = br.Close()
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+	ratingLookupCacheInvalidateAccounts(decayed...)
+	return n, nil
+}
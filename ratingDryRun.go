@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+type RatingDryRunEntry struct {
+	Account    int
+	Name       string
+	OldElo     int
+	NewElo     int
+	Delta      int
+	OldPlayed  int
+	NewPlayed  int
+	OldRank    int
+	NewRank    int
+	RankChange int
+}
+
+// rankElo assigns leaderboard places (1 is top) to accounts that played at least one game
+func rankElo(states map[int]*Elo) map[int]int {
+	ranked := []*Elo{}
+	for _, e := range states {
+		if e.Played > 0 {
+			ranked = append(ranked, e)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Elo == ranked[j].Elo {
+			return ranked[i].Account < ranked[j].Account
+		}
+		return ranked[i].Elo > ranked[j].Elo
+	})
+	ret := map[int]int{}
+	for i, e := range ranked {
+		ret[e.Account] = i + 1
+	}
+	return ret
+}
+
+// ratingDryRun recalculates whole category in read-only transaction and compares result with current ratings
+func ratingDryRun(ctx context.Context, category *RatingCategory) ([]*RatingDryRunEntry, error) {
+	rs, err := NewRatingSystem(category)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := dbpool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	games, states, err := loadEloGames(ctx, tx, category, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	old := map[int]*Elo{}
+	names := map[int]string{}
+	var e Elo
+	var name string
+	_, err = tx.QueryFunc(ctx, `select r.account, coalesce(a.display_name, ''), r.elo, r.played
+from rating as r
+join accounts as a on a.id = r.account
+where r.category = $1`, []any{category.ID}, []any{&e.Account, &name, &e.Elo, &e.Played},
+		func(_ pgx.QueryFuncRow) error {
+			ee := e
+			old[e.Account] = &ee
+			names[e.Account] = name
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	accounts := []int{}
+	for acc := range states {
+		accounts = append(accounts, acc)
+	}
+	err = seedEloStates(ctx, tx, category.ID, accounts, states, rs)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range games {
+		CalcElo(g, states, rs)
+	}
+	oldRanks := rankElo(old)
+	newRanks := rankElo(states)
+	ret := []*RatingDryRunEntry{}
+	seen := map[int]bool{}
+	for acc := range old {
+		seen[acc] = true
+	}
+	for acc := range states {
+		seen[acc] = true
+	}
+	for acc := range seen {
+		r := &RatingDryRunEntry{
+			Account: acc,
+			Name:    names[acc],
+			OldRank: oldRanks[acc],
+			NewRank: newRanks[acc],
+		}
+		if o, ok := old[acc]; ok {
+			r.OldElo = o.Elo
+			r.OldPlayed = o.Played
+		}
+		if n, ok := states[acc]; ok {
+			r.NewElo = n.Elo
+			r.NewPlayed = n.Played
+		}
+		if r.OldPlayed == 0 && r.NewPlayed == 0 {
+			continue
+		}
+		r.Delta = r.NewElo - r.OldElo
+		if r.OldRank > 0 && r.NewRank > 0 {
+			r.RankChange = r.OldRank - r.NewRank
+		}
+		ret = append(ret, r)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Delta == ret[j].Delta {
+			return ret[i].Account < ret[j].Account
+		}
+		return ret[i].Delta > ret[j].Delta
+	})
+	return ret, nil
+}
+
+func APIgetRatingDryRun(w http.ResponseWriter, r *http.Request) (int, any) {
+	categoryID, err := strconv.Atoi(mux.Vars(r)["category"])
+	if err != nil {
+		return 400, nil
+	}
+	category, err := GetRatingCategory(r.Context(), dbpool, categoryID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 404, nil
+		}
+		return 500, err
+	}
+	// engine and params can be overridden to preview rule changes
+	category.Engine = parseQueryString(r, "engine", category.Engine)
+	if p := parseQueryString(r, "params", ""); p != "" {
+		category.Params = RatingParams{}
+		err = json.Unmarshal([]byte(p), &category.Params)
+		if err != nil {
+			return 400, err
+		}
+	}
+	report, err := ratingDryRun(r.Context(), category)
+	if err != nil {
+		return 500, err
+	}
+	if parseQueryStringFiltered(r, "format", "json", "csv") != "csv" {
+		return 200, report
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"rating-dryrun-"+strconv.Itoa(categoryID)+".csv\"")
+	c := csv.NewWriter(w)
+	c.Write([]string{"account", "name", "old_elo", "new_elo", "delta", "old_played", "new_played", "old_rank", "new_rank", "rank_change"})
+	for _, e := range report {
+		c.Write([]string{strconv.Itoa(e.Account), e.Name, strconv.Itoa(e.OldElo), strconv.Itoa(e.NewElo), strconv.Itoa(e.Delta),
+			strconv.Itoa(e.OldPlayed), strconv.Itoa(e.NewPlayed), strconv.Itoa(e.OldRank), strconv.Itoa(e.NewRank), strconv.Itoa(e.RankChange)})
+	}
+	c.Flush()
+	return -1, nil
+}
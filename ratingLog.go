@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/gorilla/mux"
+)
+
+type RatingLogTeam struct {
+	Accounts []int
+	Rank     int
+	Average  float64
+	Expected float64
+}
+
+type RatingLogPlayer struct {
+	Account int
+	Team    int
+	Before  int
+	After   int
+	Diff    int
+}
+
+// RatingLog is what happened to the game when it was rated in a category,
+// Skipped holds the reason if game did not affect ratings
+type RatingLog struct {
+	Game     int
+	Category int
+	Engine   string
+	Skipped  string
+	K        float64
+	Teams    []RatingLogTeam
+	Players  []RatingLogPlayer
+	Notes    []string
+}
+
+type GameRatingLog struct {
+	Category     int
+	CategoryName string
+	Log          RatingLog
+}
+
+func GetGameRatingLogs(ctx context.Context, gid int) ([]*GameRatingLog, error) {
+	r := []*GameRatingLog{}
+	return r, pgxscan.Select(ctx, dbpool, &r, `select l.category, c.name as category_name, l.log
+from games_rating_log as l
+join rating_categories as c on c.id = l.category
+where l.game = $1
+order by l.category`, gid)
+}
+
+func APIgetGameRatingLog(_ http.ResponseWriter, r *http.Request) (int, any) {
+	gid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 400, nil
+	}
+	logs, err := GetGameRatingLogs(r.Context(), gid)
+	if err != nil {
+		return 500, err
+	}
+	return 200, logs
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+type ratingLookupCacheKey struct {
+	hash    string
+	version string
+}
+
+type ratingLookupCacheEntry struct {
+	ra      Ra
+	account int
+	expires time.Time
+}
+
+// ratingLookupCache holds rendered lookup responses, entries are also indexed
+// by account so rating updates and moderation actions can drop them early
+var ratingLookupCache = struct {
+	sync.Mutex
+	entries     map[ratingLookupCacheKey]*ratingLookupCacheEntry
+	accounts    map[int]map[ratingLookupCacheKey]bool
+	nextSweep   time.Time
+	totalGames  int
+	gamesExpire time.Time
+}{
+	entries:  map[ratingLookupCacheKey]*ratingLookupCacheEntry{},
+	accounts: map[int]map[ratingLookupCacheKey]bool{},
+}
+
+func ratingLookupCacheTTL() time.Duration {
+	return time.Duration(cfg.GetDInt(60, "ratingLookupCacheSeconds")) * time.Second
+}
+
+func ratingLookupCacheGet(hash, version string) (Ra, bool) {
+	ratingLookupCache.Lock()
+	defer ratingLookupCache.Unlock()
+	e, ok := ratingLookupCache.entries[ratingLookupCacheKey{hash, version}]
+	if !ok || time.Now().After(e.expires) {
+		return Ra{}, false
+	}
+	return e.ra, true
+}
+
+func ratingLookupCachePut(hash, version string, account int, ra Ra) {
+	ttl := ratingLookupCacheTTL()
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	k := ratingLookupCacheKey{hash, version}
+	ratingLookupCache.Lock()
+	defer ratingLookupCache.Unlock()
+	if now.After(ratingLookupCache.nextSweep) {
+		for k, e := range ratingLookupCache.entries {
+			if now.After(e.expires) {
+				ratingLookupCacheRemove(k, e)
+			}
+		}
+		ratingLookupCache.nextSweep = now.Add(ttl)
+	}
+	if old, ok := ratingLookupCache.entries[k]; ok {
+		ratingLookupCacheRemove(k, old)
+	}
+	ratingLookupCache.entries[k] = &ratingLookupCacheEntry{ra: ra, account: account, expires: now.Add(ttl)}
+	if account > 0 {
+		if ratingLookupCache.accounts[account] == nil {
+			ratingLookupCache.accounts[account] = map[ratingLookupCacheKey]bool{}
+		}
+		ratingLookupCache.accounts[account][k] = true
+	}
+}
+
+// ratingLookupCacheRemove must be called with cache locked
+func ratingLookupCacheRemove(k ratingLookupCacheKey, e *ratingLookupCacheEntry) {
+	delete(ratingLookupCache.entries, k)
+	if keys, ok := ratingLookupCache.accounts[e.account]; ok {
+		delete(keys, k)
+		if len(keys) == 0 {
+			delete(ratingLookupCache.accounts, e.account)
+		}
+	}
+}
+
+// ratingLookupCacheInvalidateAccounts drops responses of every identity linked to accounts
+func ratingLookupCacheInvalidateAccounts(accounts ...int) {
+	ratingLookupCache.Lock()
+	defer ratingLookupCache.Unlock()
+	for _, acc := range accounts {
+		for k := range ratingLookupCache.accounts[acc] {
+			delete(ratingLookupCache.entries, k)
+		}
+		delete(ratingLookupCache.accounts, acc)
+	}
+}
+
+// ratingLookupCacheInvalidateHash drops responses of identity for all game versions
+func ratingLookupCacheInvalidateHash(hash string) {
+	ratingLookupCache.Lock()
+	defer ratingLookupCache.Unlock()
+	for k, e := range ratingLookupCache.entries {
+		if k.hash == hash {
+			ratingLookupCacheRemove(k, e)
+		}
+	}
+}
+
+func ratingLookupCacheInvalidateUsername(ctx context.Context, username string) {
+	var acc int
+	err := dbpool.QueryRow(ctx, `select id from accounts where username = $1`, username).Scan(&acc)
+	if err != nil {
+		log.Printf("Failed to invalidate rating lookup cache of %q: %s", username, err.Error())
+		return
+	}
+	ratingLookupCacheInvalidateAccounts(acc)
+}
+
+// ratingLookupCacheClear is used when something affecting every response changes (rules, categories)
+func ratingLookupCacheClear() {
+	ratingLookupCache.Lock()
+	defer ratingLookupCache.Unlock()
+	clear(ratingLookupCache.entries)
+	clear(ratingLookupCache.accounts)
+	ratingLookupCache.gamesExpire = time.Time{}
+}
+
+// ratingLookupTotalGames counts games for the autohoster response, shared by all lookups
+func ratingLookupTotalGames() int {
+	now := time.Now()
+	ratingLookupCache.Lock()
+	if now.Before(ratingLookupCache.gamesExpire) {
+		c := ratingLookupCache.totalGames
+		ratingLookupCache.Unlock()
+		return c
+	}
+	ratingLookupCache.Unlock()
+	var c int
+	err := dbpool.QueryRow(context.Background(), "select count(games) from games where hidden = false and deleted = false;").Scan(&c)
+	if err != nil {
+		log.Print(err)
+		return c
+	}
+	ratingLookupCache.Lock()
+	ratingLookupCache.totalGames = c
+	ratingLookupCache.gamesExpire = now.Add(ratingLookupCacheTTL())
+	ratingLookupCache.Unlock()
+	return c
+}
+
+// ratingLookupCacheWatcher drops responses of players as soon as their game gets rated,
+// games are rated outside of frontend so recently ended ones are polled for new rating diffs
+func ratingLookupCacheWatcher() {
+	seen := map[int]bool{}
+	for {
+		time.Sleep(time.Duration(cfg.GetDInt(5, "ratingLookupCacheWatchSeconds")) * time.Second)
+		var gid int
+		var accounts []int
+		rated := map[int]bool{}
+		_, err := dbpool.QueryFunc(context.Background(), `select d.game, array_agg(distinct d.account)
+from games_rating_diff as d
+join games as g on g.id = d.game
+where g.time_ended > now() - interval '1 hour'
+group by d.game`, []any{}, []any{&gid, &accounts}, func(_ pgx.QueryFuncRow) error {
+			rated[gid] = true
+			if !seen[gid] {
+				ratingLookupCacheInvalidateAccounts(accounts...)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to poll rated games for lookup cache: %s", err.Error())
+			continue
+		}
+		seen = rated
+	}
+}
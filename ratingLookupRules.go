@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"text/template"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// RatingLookupStats is everything rating lookup rules can match on,
+// text fields of rule effects are templates executed with it
+type RatingLookupStats struct {
+	Hash       string
+	Name       string
+	Known      bool
+	Account    int
+	Registered bool
+	Terminated bool
+	Moderator  bool
+	Admin      bool
+	NewClient  bool
+	Elo        int
+	Played     int
+	Won        int
+	Lost       int
+}
+
+func (s *RatingLookupStats) Winrate() string {
+	if s.Won+s.Lost == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%03.1f%%", float64(100)*(float64(s.Won)/float64(s.Won+s.Lost)))
+}
+
+// Ratio is won to lost ratio, no losses count as one
+func (s *RatingLookupStats) Ratio() float64 {
+	return float64(s.Won) / float64(max(s.Lost, 1))
+}
+
+func (s *RatingLookupStats) TotalGames() int {
+	return ratingLookupTotalGames()
+}
+
+// Wins counts games won with the hash, works for players without account
+func (s *RatingLookupStats) Wins() int {
+	var c int
+	err := dbpool.QueryRow(context.Background(), `select count(p)
+from players as p
+join identities as i on p.identity = i.id
+where p.usertype = 'winner' and i.hash = $1`, s.Hash).Scan(&c)
+	if err != nil {
+		log.Print(err)
+	}
+	return c
+}
+
+func (s *RatingLookupStats) stat(name string) (float64, error) {
+	switch name {
+	case "elo":
+		return float64(s.Elo), nil
+	case "played":
+		return float64(s.Played), nil
+	case "won":
+		return float64(s.Won), nil
+	case "lost":
+		return float64(s.Lost), nil
+	case "ratio":
+		return s.Ratio(), nil
+	}
+	return 0, fmt.Errorf("unknown stat %q", name)
+}
+
+// RatingLookupCondition matches when every set field matches
+type RatingLookupCondition struct {
+	Hash       string             `json:"hash,omitempty"`
+	Known      *bool              `json:"known,omitempty"`
+	Registered *bool              `json:"registered,omitempty"`
+	Terminated *bool              `json:"terminated,omitempty"`
+	Moderator  *bool              `json:"moderator,omitempty"`
+	Admin      *bool              `json:"admin,omitempty"`
+	NewClient  *bool              `json:"newClient,omitempty"`
+	Gt         map[string]float64 `json:"gt,omitempty"`
+	Gte        map[string]float64 `json:"gte,omitempty"`
+	Lt         map[string]float64 `json:"lt,omitempty"`
+}
+
+// RatingLookupEffect is applied to Ra, only fields that are set are changed
+type RatingLookupEffect struct {
+	Autohoster    *bool   `json:"autohoster,omitempty"`
+	Dummy         *bool   `json:"dummy,omitempty"`
+	Star          [3]int  `json:"star,omitempty"`
+	Medal         int     `json:"medal,omitempty"`
+	Level         *int    `json:"level,omitempty"`
+	Elo           *string `json:"elo,omitempty"`
+	Details       *string `json:"details,omitempty"`
+	AppendDetails string  `json:"appendDetails,omitempty"`
+	Name          *string `json:"name,omitempty"`
+	Tag           *string `json:"tag,omitempty"`
+	NameColor     *[3]int `json:"nameColor,omitempty"`
+	TagColor      *[3]int `json:"tagColor,omitempty"`
+	EloColor      *[3]int `json:"eloColor,omitempty"`
+}
+
+type RatingLookupRule struct {
+	Description string                `json:"description,omitempty"`
+	When        RatingLookupCondition `json:"when"`
+	Set         RatingLookupEffect    `json:"set"`
+	// Stop ends rule processing when rule matched
+	Stop bool `json:"stop,omitempty"`
+
+	templates map[string]*template.Template
+}
+
+// RatingLookupConfig is ordered list of rules, later rules override earlier ones
+type RatingLookupConfig struct {
+	Category int                `json:"category"`
+	Rules    []RatingLookupRule `json:"rules"`
+}
+
+const defaultRatingLookupRules = `{
+	"category": 2,
+	"rules": [
+		{"description": "Autohoster", "when": {"hash": "a0c124533ddcaf5a19cc7d593c33d750680dc428b0021672e0b86a9b0dcfd711"}, "stop": true,
+			"set": {"autohoster": true, "details": "wz2100-autohost.net\n\nTotal games served: {{.TotalGames}}\n", "elo": "Visit wz2100-autohost.net"}},
+		{"description": "Fake autohoster", "when": {"hash": "21494390542d3bb20bb39c0986c2c6d9a338be2db3f68b47610744be6b2045f2"}, "stop": true,
+			"set": {"details": "Used to be CleptoMantis but now he is fake Autohoster", "elo": "Fake autohoster", "nameColor": [0, 0, 0], "eloColor": [255, 0, 0]}},
+		{"description": "Unknown player", "when": {"known": false}, "stop": true,
+			"set": {"details": "Casual noname", "elo": "Unknown player ({{printf \"% 4d\" .Wins}} wins)", "nameColor": [102, 102, 102], "eloColor": [255, 68, 68]}},
+		{"description": "Name for new clients", "when": {"newClient": true}, "set": {"name": "{{.Name}}"}},
+		{"description": "Registered", "when": {"registered": true},
+			"set": {"details": "Played: {{printf \"% 4d\" .Played}}\nWon: {{printf \"% 4d\" .Won}} Lost: {{printf \"% 4d\" .Lost}}\n", "elo": "R[{{printf \"% 4d\" .Elo}}] {{printf \"% 4d\" .Played}} {{.Winrate}}"}},
+		{"description": "Moderator details", "when": {"registered": true, "moderator": true}, "set": {"appendDetails": "Allowed to moderate and request rooms\n"}},
+		{"description": "Not registered", "when": {"registered": false},
+			"set": {"details": "Not registered user.\n", "elo": "Unauthorized player", "nameColor": [102, 102, 102], "eloColor": [255, 68, 68]}},
+		{"description": "Moderator", "when": {"moderator": true, "newClient": true}, "set": {"level": 7, "tag": "Moderator", "tagColor": [17, 170, 17]}},
+		{"description": "Moderator (old client)", "when": {"moderator": true, "newClient": false}, "set": {"level": 7, "name": "Moderator", "nameColor": [17, 170, 17]}},
+		{"description": "Admin", "when": {"admin": true, "newClient": true}, "set": {"level": 8, "tag": "Admin", "tagColor": [51, 255, 51]}},
+		{"description": "Admin (old client)", "when": {"admin": true, "newClient": false}, "set": {"level": 8, "name": "Admin", "nameColor": [51, 255, 51]}},
+		{"description": "Terminated", "when": {"terminated": true, "newClient": true}, "stop": true,
+			"set": {"level": 0, "tag": "", "elo": "Account terminated", "nameColor": [255, 34, 34], "eloColor": [255, 34, 34], "tagColor": [255, 34, 34]}},
+		{"description": "Terminated (old client)", "when": {"terminated": true, "newClient": false}, "stop": true,
+			"set": {"level": 0, "name": "", "elo": "Account terminated", "nameColor": [255, 34, 34], "eloColor": [255, 34, 34], "tagColor": [255, 34, 34]}},
+		{"description": "Not enough games", "when": {"lt": {"played": 5}}, "stop": true, "set": {"dummy": true}},
+		{"description": "Not registered dummy", "when": {"registered": false}, "stop": true, "set": {"dummy": true}},
+		{"description": "Bronze medal", "when": {"gte": {"won": 6}, "gt": {"ratio": 3}}, "set": {"medal": 3}},
+		{"description": "Silver medal", "when": {"gte": {"won": 12}, "gt": {"ratio": 4}}, "set": {"medal": 2}},
+		{"description": "Gold medal", "when": {"gte": {"won": 24}, "gt": {"ratio": 6}}, "set": {"medal": 1}},
+		{"description": "Rating star 3", "when": {"gt": {"elo": 1400}}, "set": {"star": [3, 0, 0]}},
+		{"description": "Rating star 2", "when": {"gt": {"elo": 1550}}, "set": {"star": [2, 0, 0]}},
+		{"description": "Rating star 1", "when": {"gt": {"elo": 1800}}, "set": {"star": [1, 0, 0]}},
+		{"description": "Played star 3", "when": {"gt": {"played": 10}}, "set": {"star": [0, 3, 0]}},
+		{"description": "Played star 2", "when": {"gt": {"played": 30}}, "set": {"star": [0, 2, 0]}},
+		{"description": "Played star 1", "when": {"gt": {"played": 60}}, "set": {"star": [0, 1, 0]}},
+		{"description": "Won star 3", "when": {"gt": {"won": 10}}, "set": {"star": [0, 0, 3]}},
+		{"description": "Won star 2", "when": {"gt": {"won": 30}}, "set": {"star": [0, 0, 2]}},
+		{"description": "Won star 1", "when": {"gt": {"won": 60}}, "set": {"star": [0, 0, 1]}}
+	]
+}`
+
+var ratingLookupConfig atomic.Pointer[RatingLookupConfig]
+
+// ParseRatingLookupConfig decodes rules and compiles their text templates
+func ParseRatingLookupConfig(data []byte) (*RatingLookupConfig, error) {
+	c := &RatingLookupConfig{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	err := d.Decode(c)
+	if err != nil {
+		return nil, err
+	}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		rule.templates = map[string]*template.Template{}
+		texts := map[string]*string{
+			"elo":           rule.Set.Elo,
+			"details":       rule.Set.Details,
+			"appendDetails": &rule.Set.AppendDetails,
+			"name":          rule.Set.Name,
+			"tag":           rule.Set.Tag,
+		}
+		for k, v := range texts {
+			if v == nil || !strings.Contains(*v, "{{") {
+				continue
+			}
+			t, err := template.New(k).Parse(*v)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d (%s) %s: %w", i, rule.Description, k, err)
+			}
+			rule.templates[k] = t
+		}
+		for _, m := range []map[string]float64{rule.When.Gt, rule.When.Gte, rule.When.Lt} {
+			for k := range m {
+				_, err := (&RatingLookupStats{}).stat(k)
+				if err != nil {
+					return nil, fmt.Errorf("rule %d (%s): %w", i, rule.Description, err)
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+func loadRatingLookupConfig(ctx context.Context) error {
+	var data []byte
+	err := dbpool.QueryRow(ctx, `select config from rating_lookup_config where id = 1`).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		data = []byte(defaultRatingLookupRules)
+	} else if err != nil {
+		return err
+	}
+	c, err := ParseRatingLookupConfig(data)
+	if err != nil {
+		return err
+	}
+	ratingLookupConfig.Store(c)
+	return nil
+}
+
+func getRatingLookupConfig() *RatingLookupConfig {
+	c := ratingLookupConfig.Load()
+	if c == nil {
+		c, err := ParseRatingLookupConfig([]byte(defaultRatingLookupRules))
+		if err != nil {
+			log.Panicf("Default rating lookup rules are broken: %s", err.Error())
+		}
+		return c
+	}
+	return c
+}
+
+func matchBool(want *bool, v bool) bool {
+	return want == nil || *want == v
+}
+
+func (c *RatingLookupCondition) Match(s *RatingLookupStats) bool {
+	if c.Hash != "" && c.Hash != s.Hash {
+		return false
+	}
+	if !matchBool(c.Known, s.Known) || !matchBool(c.Registered, s.Registered) || !matchBool(c.Terminated, s.Terminated) ||
+		!matchBool(c.Moderator, s.Moderator) || !matchBool(c.Admin, s.Admin) || !matchBool(c.NewClient, s.NewClient) {
+		return false
+	}
+	for k, v := range c.Gt {
+		if st, _ := s.stat(k); !(st > v) {
+			return false
+		}
+	}
+	for k, v := range c.Gte {
+		if st, _ := s.stat(k); !(st >= v) {
+			return false
+		}
+	}
+	for k, v := range c.Lt {
+		if st, _ := s.stat(k); !(st < v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *RatingLookupRule) text(name string, v string, s *RatingLookupStats) string {
+	t, ok := r.templates[name]
+	if !ok {
+		return v
+	}
+	b := bytes.NewBufferString("")
+	err := t.Execute(b, s)
+	if err != nil {
+		log.Printf("Rating lookup rule %q %s failed: %s", r.Description, name, err.Error())
+	}
+	return b.String()
+}
+
+func (r *RatingLookupRule) Apply(m *Ra, s *RatingLookupStats) {
+	e := &r.Set
+	if e.Autohoster != nil {
+		m.Autohoster = *e.Autohoster
+	}
+	if e.Dummy != nil {
+		m.Dummy = *e.Dummy
+	}
+	for i, v := range e.Star {
+		if v != 0 {
+			m.Star[i] = v
+		}
+	}
+	if e.Medal != 0 {
+		m.Medal = e.Medal
+	}
+	if e.Level != nil {
+		m.Level = *e.Level
+	}
+	if e.Elo != nil {
+		m.Elo = r.text("elo", *e.Elo, s)
+	}
+	if e.Details != nil {
+		m.Details = r.text("details", *e.Details, s)
+	}
+	if e.AppendDetails != "" {
+		m.Details += r.text("appendDetails", e.AppendDetails, s)
+	}
+	if e.Name != nil {
+		m.Name = r.text("name", *e.Name, s)
+	}
+	if e.Tag != nil {
+		m.Tag = r.text("tag", *e.Tag, s)
+	}
+	if e.NameColor != nil {
+		m.NameTextColorOverride = *e.NameColor
+	}
+	if e.TagColor != nil {
+		m.TagTextColorOverride = *e.TagColor
+	}
+	if e.EloColor != nil {
+		m.EloTextColorOverride = *e.EloColor
+	}
+}
+
+func (c *RatingLookupConfig) Evaluate(s *RatingLookupStats) Ra {
+	m := Ra{
+		NameTextColorOverride: [3]int{0xff, 0xff, 0xff},
+		TagTextColorOverride:  [3]int{0xff, 0xff, 0xff},
+		EloTextColorOverride:  [3]int{0xff, 0xff, 0xff},
+	}
+	for i := range c.Rules {
+		if !c.Rules[i].When.Match(s) {
+			continue
+		}
+		c.Rules[i].Apply(&m, s)
+		if c.Rules[i].Stop {
+			break
+		}
+	}
+	return m
+}
+
+func modRatingLookupHandler(w http.ResponseWriter, r *http.Request) {
+	c := getRatingLookupConfig()
+	j, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": err.Error()})
+		return
+	}
+	basicLayoutLookupRespond("modRatingLookup", w, r, map[string]any{"Rules": string(j)})
+}
+
+func modRatingLookupPOST(w http.ResponseWriter, r *http.Request) {
+	if !checkFormParse(w, r) {
+		return
+	}
+	data := []byte(r.FormValue("rules"))
+	c, err := ParseRatingLookupConfig(data)
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Rules are invalid: " + err.Error()})
+		return
+	}
+	_, err = dbpool.Exec(r.Context(), `insert into rating_lookup_config (id, config, updated_by) values (1, $1, $2)
+on conflict (id) do update set config = excluded.config, updated_by = excluded.updated_by, time_updated = now()`, data, sessionGetUsername(r))
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	ratingLookupConfig.Store(c)
+	ratingLookupCacheClear()
+	err = modSendWebhook(fmt.Sprintf("Administrator `%s` updated rating lookup rules (%d rules)", sessionGetUsername(r), len(c.Rules)))
+	if err != nil {
+		log.Println(err)
+	}
+	w.Header().Set("Refresh", "1; /moderation/ratingLookup")
+	basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msggreen": true, "msg": "Rules saved"})
+}
+
+// APIratingLookupPreview evaluates rules from the form (or current ones) for hash without saving them
+func APIratingLookupPreview(w http.ResponseWriter, r *http.Request) (int, any) {
+	err := r.ParseForm()
+	if err != nil {
+		return 400, err
+	}
+	c := getRatingLookupConfig()
+	if rules := r.FormValue("rules"); rules != "" {
+		c, err = ParseRatingLookupConfig([]byte(rules))
+		if err != nil {
+			return 400, err
+		}
+	}
+	hash := r.FormValue("hash")
+	if hash == "" {
+		return 400, errors.New("hash is required")
+	}
+	s, err := ratingLookupStats(r.Context(), c.Category, hash, r.FormValue("version"))
+	if err != nil {
+		return 500, err
+	}
+	return 200, map[string]any{
+		"Stats":  s,
+		"Rating": c.Evaluate(s),
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+const ratingRecalcBatchSize = 200
+
+type RatingRecalcJob struct {
+	ID          int
+	Category    int
+	FromGame    int
+	LastGame    *int
+	Total       int
+	Processed   int
+	Status      string
+	Error       *string
+	StartedBy   *string
+	TimeStarted time.Time
+	TimeUpdated time.Time
+}
+
+var ratingRecalcWakeup = make(chan struct{}, 1)
+
+var errRatingCategoryArchived = errors.New("rating category is archived or does not exist")
+
+func GetRatingRecalcJob(ctx context.Context, id int) (*RatingRecalcJob, error) {
+	r := []*RatingRecalcJob{}
+	err := pgxscan.Select(ctx, dbpool, &r, `SELECT * FROM rating_recalc_jobs WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(r) != 1 {
+		return nil, pgx.ErrNoRows
+	}
+	return r[0], nil
+}
+
+// QueueRatingRecalc creates job that will recalculate category starting with fromGame,
+// fromGame of 0 recalculates whole category
+func QueueRatingRecalc(ctx context.Context, category int, fromGame int, startedBy string) (int, error) {
+	var id int
+	err := dbpool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var err error
+		id, err = queueRatingRecalcTx(ctx, tx, category, fromGame, startedBy)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	ratingRecalcWake()
+	return id, nil
+}
+
+// queueRatingRecalcTx inserts job as part of bigger change, ratingRecalcWake must be called after commit
+func queueRatingRecalcTx(ctx context.Context, tx pgx.Tx, category int, fromGame int, startedBy string) (int, error) {
+	var id int
+	err := tx.QueryRow(ctx, `insert into rating_recalc_jobs (category, from_game, started_by)
+select $1, $2, $3 from rating_categories where id = $1 and archived = false
+returning id`, category, fromGame, startedBy).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errRatingCategoryArchived
+	}
+	return id, err
+}
+
+func ratingRecalcWake() {
+	select {
+	case ratingRecalcWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// ratingRecalcRunner processes jobs one by one, jobs left running resume from their checkpoint
+func ratingRecalcRunner() {
+	for {
+		r := []*RatingRecalcJob{}
+		err := pgxscan.Select(context.Background(), dbpool, &r,
+			`SELECT * FROM rating_recalc_jobs WHERE status = 'queued' OR status = 'running' ORDER BY status = 'running' DESC, id LIMIT 1`)
+		if err != nil {
+			log.Printf("Failed to fetch rating recalculation jobs: %s", err.Error())
+			time.Sleep(time.Minute)
+			continue
+		}
+		if len(r) == 0 {
+			<-ratingRecalcWakeup
+			continue
+		}
+		j := r[0]
+		ratingWriteLock.Lock()
+		isEloRecalculating.Store(true)
+		err = runRatingRecalcJob(context.Background(), j)
+		isEloRecalculating.Store(false)
+		ratingWriteLock.Unlock()
+		if err != nil {
+			log.Printf("Rating recalculation job %d failed: %s", j.ID, err.Error())
+			j.Status = "failed"
+			errs := err.Error()
+			j.Error = &errs
+			_, err = dbpool.Exec(context.Background(), `update rating_recalc_jobs set status = 'failed', error = $2, time_updated = now() where id = $1`, j.ID, errs)
+			if err != nil {
+				log.Printf("Failed to mark rating recalculation job %d as failed: %s", j.ID, err.Error())
+			}
+			WSRatingRecalcProgress(j)
+		}
+	}
+}
+
+// ratingRecalcJobBegin rolls category back to the state before job's first game
+func ratingRecalcJobBegin(ctx context.Context, j *RatingRecalcJob) error {
+	tx, err := dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if j.FromGame <= 0 {
+		_, err = tx.Exec(ctx, `delete from games_rating_diff where category = $1`, j.Category)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `delete from games_rating_log where category = $1`, j.Category)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `delete from rating where category = $1`, j.Category)
+		if err != nil {
+			return err
+		}
+	} else {
+		var affected []int
+		err = tx.QueryRow(ctx, `select coalesce(array_agg(distinct account), '{}') from games_rating_diff where category = $1 and game >= $2`,
+			j.Category, j.FromGame).Scan(&affected)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `delete from rating where category = $1 and account = any($2)`, j.Category, affected)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `insert into rating (category, account, elo, played, won, lost, time_played, mu, sigma, volatility, time_last_played, time_decayed)
+select distinct on (account) category, account, elo, played, won, lost, time_played, mu, sigma, volatility, time_last_played, time_decayed
+from games_rating_diff
+where category = $1 and account = any($2) and game < $3
+order by account, game desc`, j.Category, affected, j.FromGame)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `delete from games_rating_diff where category = $1 and game >= $2`, j.Category, j.FromGame)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `delete from games_rating_log where category = $1 and game >= $2`, j.Category, j.FromGame)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.QueryRow(ctx, `select count(distinct g.id) `+eloGamesFrom, j.Category, j.FromGame).Scan(&j.Total)
+	if err != nil {
+		return err
+	}
+	j.Status = "running"
+	_, err = tx.Exec(ctx, `update rating_recalc_jobs set status = 'running', total = $2, time_updated = now() where id = $1`, j.ID, j.Total)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// loadEloStates fills in current ratings of accounts, ones not rated yet start from seed or initial rating
+func loadEloStates(ctx context.Context, category int, accounts []int, states map[int]*Elo, rs RatingSystem) error {
+	var e Elo
+	_, err := dbpool.QueryFunc(ctx, `select account, elo, mu, sigma, volatility, played, won, lost, time_played,
+	coalesce(extract(epoch from time_last_played)::int, 0), coalesce(extract(epoch from time_decayed)::int, 0)
+from rating where category = $1 and account = any($2)`, []any{category, accounts},
+		[]any{&e.Account, &e.Elo, &e.Mu, &e.Sigma, &e.Volatility, &e.Played, &e.Won, &e.Lost, &e.TimePlayed, &e.LastPlayed, &e.TimeDecayed},
+		func(_ pgx.QueryFuncRow) error {
+			ee := e
+			states[e.Account] = &ee
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	missing := []int{}
+	for _, acc := range accounts {
+		if _, ok := states[acc]; !ok {
+			missing = append(missing, acc)
+		}
+	}
+	return seedEloStates(ctx, dbpool, category, missing, states, rs)
+}
+
+func ratingRecalcJobCheckpoint(ctx context.Context, j *RatingRecalcJob, games []*EloGame, states map[int]*Elo) error {
+	b := pgx.Batch{}
+	touched := map[int]bool{}
+	for _, g := range games {
+		if g.Log != nil {
+			b.Queue(`insert into games_rating_log (game, category, log) values ($1, $2, $3)`, g.ID, j.Category, g.Log)
+		}
+		for _, p := range g.Players {
+			if p.After == nil {
+				continue
+			}
+			touched[p.Account] = true
+			b.Queue(`insert into games_rating_diff (game, category, account, diff, elo, mu, sigma, volatility, played, won, lost, time_played, time_last_played, time_decayed)
+values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, to_timestamp(nullif($13::int, 0)), to_timestamp(nullif($14::int, 0)))`,
+				g.ID, j.Category, p.Account, p.EloDiff, p.After.Elo, p.After.Mu, p.After.Sigma, p.After.Volatility, p.After.Played, p.After.Won, p.After.Lost, p.After.TimePlayed,
+				p.After.LastPlayed, p.After.TimeDecayed)
+		}
+	}
+	for acc := range touched {
+		p := states[acc]
+		b.Queue(`delete from rating where category = $1 and account = $2`, j.Category, acc)
+		b.Queue(`insert into rating (category, account, elo, played, won, lost, time_played, mu, sigma, volatility, time_last_played, time_decayed)
+values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, to_timestamp(nullif($11::int, 0)), to_timestamp(nullif($12::int, 0)))`,
+			j.Category, acc, p.Elo, p.Played, p.Won, p.Lost, p.TimePlayed, p.Mu, p.Sigma, p.Volatility, p.LastPlayed, p.TimeDecayed)
+	}
+	lastGame := games[len(games)-1].ID
+	b.Queue(`update rating_recalc_jobs set last_game = $2, processed = processed + $3, time_updated = now() where id = $1`, j.ID, lastGame, len(games))
+	tx, err := dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	br := tx.SendBatch(ctx, &b)
+	for i := 0; i < b.Len(); i++ {
+		_, err = br.Exec()
+		if err != nil {
+			br.Close()
+			return err
+		}
+	}
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	for acc := range touched {
+		ratingLookupCacheInvalidateAccounts(acc)
+	}
+	j.LastGame = &lastGame
+	j.Processed += len(games)
+	j.TimeUpdated = time.Now()
+	return nil
+}
+
+func runRatingRecalcJob(ctx context.Context, j *RatingRecalcJob) error {
+	category, err := GetRatingCategory(ctx, dbpool, j.Category)
+	if err != nil {
+		return err
+	}
+	rs, err := NewRatingSystem(category)
+	if err != nil {
+		return err
+	}
+	if j.Status == "queued" {
+		err = ratingRecalcJobBegin(ctx, j)
+		if err != nil {
+			return err
+		}
+		log.Printf("Rating recalculation job %d started for category %d from game %d (%d games)", j.ID, j.Category, j.FromGame, j.Total)
+	} else {
+		log.Printf("Rating recalculation job %d resumed for category %d (%d/%d games)", j.ID, j.Category, j.Processed, j.Total)
+	}
+	WSRatingRecalcProgress(j)
+	states := map[int]*Elo{}
+	for {
+		from := j.FromGame
+		if j.LastGame != nil {
+			from = *j.LastGame + 1
+		}
+		games, accounts, err := loadEloGames(ctx, dbpool, category, from, ratingRecalcBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(games) == 0 {
+			break
+		}
+		missing := []int{}
+		for acc := range accounts {
+			if _, ok := states[acc]; !ok {
+				missing = append(missing, acc)
+			}
+		}
+		err = loadEloStates(ctx, j.Category, missing, states, rs)
+		if err != nil {
+			return err
+		}
+		for _, g := range games {
+			l := CalcElo(g, states, rs)
+			l.Category = category.ID
+			l.Engine = category.Engine
+		}
+		err = ratingRecalcJobCheckpoint(ctx, j, games, states)
+		if err != nil {
+			return err
+		}
+		WSRatingRecalcProgress(j)
+	}
+	j.Status = "done"
+	_, err = dbpool.Exec(ctx, `update rating_recalc_jobs set status = 'done', time_updated = now() where id = $1`, j.ID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rating recalculation job %d done", j.ID)
+	WSRatingRecalcProgress(j)
+	return nil
+}
+
+func modRatingRecalcPOST(w http.ResponseWriter, r *http.Request) {
+	if !checkFormParse(w, r) {
+		return
+	}
+	category := parseFormInt(r, "category")
+	if category == nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Category is missing"})
+		return
+	}
+	c, err := GetRatingCategory(r.Context(), dbpool, *category)
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Failed to get rating category: " + err.Error()})
+		return
+	}
+	if c.Archived {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Rating category is archived, its standings are frozen"})
+		return
+	}
+	fromGame := 0
+	if v := parseFormInt(r, "fromGame"); v != nil {
+		fromGame = *v
+	}
+	id, err := QueueRatingRecalc(r.Context(), *category, fromGame, sessionGetUsername(r))
+	if err != nil {
+		basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msgred": true, "msg": "Database error: " + err.Error()})
+		return
+	}
+	err = modSendWebhook(fmt.Sprintf("Administrator `%s` queued rating recalculation of category `%d` from game `%d` (job `%d`)", sessionGetUsername(r), *category, fromGame, id))
+	if err != nil {
+		log.Println(err)
+	}
+	w.Header().Set("Refresh", "1; /moderation/ratingRecalc")
+	basicLayoutLookupRespond("plainmsg", w, r, map[string]any{"msggreen": true, "msg": "Queued job " + strconv.Itoa(id)})
+}
+
+func APIgetRatingRecalcJobs(_ http.ResponseWriter, r *http.Request) (int, any) {
+	return genericViewRequest[RatingRecalcJob](r, genericRequestParams{
+		tableName:         "rating_recalc_jobs",
+		cursorKey:         "id",
+		limitClamp:        500,
+		sortDefaultOrder:  "desc",
+		sortDefaultColumn: "id",
+		sortColumns:       []string{"ID", "Category", "TimeStarted", "TimeUpdated"},
+		filterColumnsFull: []string{"id", "category", "status"},
+		columnMappings: map[string]string{
+			"ID":          "id",
+			"Category":    "category",
+			"Status":      "status",
+			"TimeStarted": "time_started",
+			"TimeUpdated": "time_updated",
+		},
+	})
+}
+
+func APIgetRatingRecalcJob(_ http.ResponseWriter, r *http.Request) (int, any) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 400, nil
+	}
+	j, err := GetRatingRecalcJob(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 404, nil
+		}
+		return 500, err
+	}
+	return 200, j
+}
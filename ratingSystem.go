@@ -0,0 +1,484 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// RatingParams are per-category tunables stored in rating_categories.params,
+// zero values are replaced with engine defaults
+type RatingParams struct {
+	K                 float64 `json:"k"`
+	Initial           float64 `json:"initial"`
+	InitialDeviation  float64 `json:"initialDeviation"`
+	InitialVolatility float64 `json:"initialVolatility"`
+	Tau               float64 `json:"tau"`
+	Beta              float64 `json:"beta"`
+	DrawProbability   float64 `json:"drawProbability"`
+	// decay starts after InactiveDays without rated games, 0 disables it
+	InactiveDays    float64 `json:"inactiveDays"`
+	DecayPerDay     float64 `json:"decayPerDay"`
+	DecayFloor      float64 `json:"decayFloor"`
+	DeviationGrowth float64 `json:"deviationGrowth"`
+	// when category ends successor is created for SeasonDays,
+	// CarryOver is part of the distance from initial rating that is kept (0 is full reset)
+	SeasonDays float64 `json:"seasonDays"`
+	CarryOver  float64 `json:"carryOver"`
+}
+
+// RatingSystem is an engine that rating category uses to update ratings
+type RatingSystem interface {
+	// Reset puts rating into initial state (counters are not touched)
+	Reset(e *Elo)
+	// Rate updates ratings of teams, ranks hold placement of each team (0 is first, equal is a draw),
+	// team averages, expected scores and other calculation details are written to l
+	Rate(teams [][]*Elo, ranks []int, l *RatingLog)
+	// Decay applies inactivity penalty accumulated up to unix time now
+	Decay(e *Elo, now int)
+}
+
+var ratingSystems = map[string]func(p RatingParams) RatingSystem{
+	"elo":       newRatingSystemElo,
+	"glicko2":   newRatingSystemGlicko2,
+	"trueskill": newRatingSystemTrueSkill,
+}
+
+func NewRatingSystem(c *RatingCategory) (RatingSystem, error) {
+	engine := c.Engine
+	if engine == "" {
+		engine = "elo"
+	}
+	f, ok := ratingSystems[engine]
+	if !ok {
+		return nil, fmt.Errorf("rating category %d has unknown rating engine %q", c.ID, engine)
+	}
+	return f(c.Params), nil
+}
+
+func paramOrDefault(v, d float64) float64 {
+	if v == 0 {
+		return d
+	}
+	return v
+}
+
+type ratingDecay struct {
+	inactiveDays    float64
+	perDay          float64
+	floor           float64
+	deviationGrowth float64
+}
+
+func newRatingDecay(p RatingParams, initial float64) ratingDecay {
+	return ratingDecay{
+		inactiveDays:    p.InactiveDays,
+		perDay:          p.DecayPerDay,
+		floor:           paramOrDefault(p.DecayFloor, initial),
+		deviationGrowth: p.DeviationGrowth,
+	}
+}
+
+// pending returns days of inactivity that were not decayed yet and marks them as decayed,
+// decay is linear so applying it in several steps gives the same result
+func (d ratingDecay) pending(e *Elo, now int) float64 {
+	if d.inactiveDays <= 0 || e.LastPlayed == 0 {
+		return 0
+	}
+	from := max(e.LastPlayed+int(d.inactiveDays*86400), e.TimeDecayed)
+	if now <= from {
+		return 0
+	}
+	e.TimeDecayed = now
+	return float64(now-from) / 86400
+}
+
+// decayDeviation grows deviation up to maxDeviation and lowers rating towards the floor
+func (d ratingDecay) decayDeviation(e *Elo, now int, maxDeviation float64) {
+	days := d.pending(e, now)
+	if days == 0 {
+		return
+	}
+	e.Sigma = math.Min(math.Sqrt(e.Sigma*e.Sigma+d.deviationGrowth*d.deviationGrowth*days), maxDeviation)
+	if e.Mu > d.floor {
+		e.Mu = math.Max(d.floor, e.Mu-d.perDay*days)
+	}
+	e.Elo = int(math.Round(e.Mu))
+}
+
+func rankScore(a, b int) float64 {
+	if a < b {
+		return 1
+	} else if a > b {
+		return 0
+	}
+	return 0.5
+}
+
+type ratingSystemElo struct {
+	k       float64
+	initial float64
+	decay   ratingDecay
+}
+
+func newRatingSystemElo(p RatingParams) RatingSystem {
+	initial := paramOrDefault(p.Initial, 1400)
+	return &ratingSystemElo{
+		k:       paramOrDefault(p.K, 20),
+		initial: initial,
+		decay:   newRatingDecay(p, initial),
+	}
+}
+
+func (s *ratingSystemElo) Decay(e *Elo, now int) {
+	days := s.decay.pending(e, now)
+	if days == 0 || float64(e.Elo) <= s.decay.floor {
+		return
+	}
+	e.Elo = max(int(s.decay.floor), e.Elo-int(math.Round(s.decay.perDay*days)))
+	e.Mu = float64(e.Elo)
+}
+
+func (s *ratingSystemElo) Reset(e *Elo) {
+	e.Elo = int(s.initial)
+	e.Mu = s.initial
+	e.Sigma = 0
+	e.Volatility = 0
+}
+
+func teamAverageElo(t []*Elo) int {
+	sum := 0
+	for _, e := range t {
+		sum += e.Elo
+	}
+	return sum / len(t)
+}
+
+// Rate compares every pair of teams, each team gets average of pairwise
+// changes. Team strength is average rating of its players plus
+// 400*log10(size) so that team with more players is expected to win.
+func (s *ratingSystemElo) Rate(teams [][]*Elo, ranks []int, l *RatingLog) {
+	if len(teams) < 2 {
+		l.Skipped = fmt.Sprintf("Elo can not rate %d teams", len(teams))
+		return
+	}
+	allDraw := true
+	for _, r := range ranks {
+		if r != ranks[0] {
+			allDraw = false
+		}
+	}
+	if allDraw {
+		l.Skipped = "Elo does not rate draws"
+		return
+	}
+	l.K = s.k
+	eff := make([]int, len(teams))
+	for ti, t := range teams {
+		avg := teamAverageElo(t)
+		eff[ti] = avg + int(math.Round(400*math.Log10(float64(len(t)))))
+		l.Teams[ti].Average = float64(avg)
+	}
+	pairs := float64(len(teams) - 1)
+	deltas := make([]float64, len(teams))
+	for i := range teams {
+		for j := i + 1; j < len(teams); j++ {
+			expected := 1 / (1 + math.Pow(10, float64(eff[j]-eff[i])/400))
+			l.Teams[i].Expected += expected / pairs
+			l.Teams[j].Expected += (1 - expected) / pairs
+			var d float64
+			if ranks[i] < ranks[j] {
+				d = EloDiff(s.k, eff[i], eff[j])
+			} else if ranks[i] > ranks[j] {
+				d = -EloDiff(s.k, eff[j], eff[i])
+			} else {
+				d = s.k * (0.5 - expected)
+			}
+			deltas[i] += d
+			deltas[j] -= d
+		}
+	}
+	for ti, t := range teams {
+		diff := int(deltas[ti] / pairs)
+		l.Notes = append(l.Notes, fmt.Sprintf("Team %d elo diff: %d", ti, diff))
+		for _, e := range t {
+			e.Elo += diff
+			e.Mu = float64(e.Elo)
+		}
+	}
+}
+
+const glicko2Scale = 173.7178
+
+type ratingSystemGlicko2 struct {
+	initial    float64
+	deviation  float64
+	volatility float64
+	tau        float64
+	decay      ratingDecay
+}
+
+func newRatingSystemGlicko2(p RatingParams) RatingSystem {
+	initial := paramOrDefault(p.Initial, 1500)
+	return &ratingSystemGlicko2{
+		initial:    initial,
+		deviation:  paramOrDefault(p.InitialDeviation, 350),
+		volatility: paramOrDefault(p.InitialVolatility, 0.06),
+		tau:        paramOrDefault(p.Tau, 0.5),
+		decay:      newRatingDecay(p, initial),
+	}
+}
+
+func (s *ratingSystemGlicko2) Decay(e *Elo, now int) {
+	s.decay.decayDeviation(e, now, s.deviation)
+}
+
+func (s *ratingSystemGlicko2) Reset(e *Elo) {
+	e.Mu = s.initial
+	e.Sigma = s.deviation
+	e.Volatility = s.volatility
+	e.Elo = int(math.Round(e.Mu))
+}
+
+func glicko2G(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+// glicko2Volatility is step 5 of Glicko-2 paper (Illinois algorithm)
+func (s *ratingSystemGlicko2) glicko2Volatility(phi, sigma, v, delta float64) float64 {
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(s.tau*s.tau)
+	}
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*s.tau) < 0 {
+			k++
+		}
+		B = a - k*s.tau
+	}
+	fA, fB := f(A), f(B)
+	for i := 0; math.Abs(B-A) > 0.000001 && i < 100; i++ {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	return math.Exp(A / 2)
+}
+
+func (s *ratingSystemGlicko2) Rate(teams [][]*Elo, ranks []int, l *RatingLog) {
+	if len(teams) < 2 {
+		l.Skipped = fmt.Sprintf("Glicko-2 can not rate %d teams", len(teams))
+		return
+	}
+	type composite struct {
+		mu, phi float64
+	}
+	// teams are treated as single opponents with averaged rating and deviation
+	comp := make([]composite, len(teams))
+	bonus := make([]float64, len(teams))
+	for ti, t := range teams {
+		for _, e := range t {
+			comp[ti].mu += (e.Mu - 1500) / glicko2Scale
+			comp[ti].phi += (e.Sigma / glicko2Scale) * (e.Sigma / glicko2Scale)
+		}
+		comp[ti].mu /= float64(len(t))
+		comp[ti].phi = math.Sqrt(comp[ti].phi / float64(len(t)))
+		l.Teams[ti].Average = comp[ti].mu*glicko2Scale + 1500
+		// same team size advantage as 400*log10(size) in elo, applies to players of the team too
+		bonus[ti] = math.Log(float64(len(t)))
+		comp[ti].mu += bonus[ti]
+		l.Notes = append(l.Notes, fmt.Sprintf("Team %d composite rating deviation: %.1f", ti, comp[ti].phi*glicko2Scale))
+	}
+	for ti := range comp {
+		for oi, o := range comp {
+			if oi != ti {
+				l.Teams[ti].Expected += 1 / (1 + math.Exp(-glicko2G(o.phi)*(comp[ti].mu-o.mu))) / float64(len(comp)-1)
+			}
+		}
+	}
+	type result struct {
+		mu, phi, sigma float64
+	}
+	res := make([][]result, len(teams))
+	for ti, t := range teams {
+		res[ti] = make([]result, len(t))
+		for pi, e := range t {
+			mu := (e.Mu - 1500) / glicko2Scale
+			phi := e.Sigma / glicko2Scale
+			vInv := 0.0
+			deltaSum := 0.0
+			for oi, o := range comp {
+				if oi == ti {
+					continue
+				}
+				g := glicko2G(o.phi)
+				E := 1 / (1 + math.Exp(-g*(mu+bonus[ti]-o.mu)))
+				vInv += g * g * E * (1 - E)
+				deltaSum += g * (rankScore(ranks[ti], ranks[oi]) - E)
+			}
+			v := 1 / vInv
+			sigma := s.glicko2Volatility(phi, e.Volatility, v, v*deltaSum)
+			phiStar := math.Sqrt(phi*phi + sigma*sigma)
+			phiNew := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+			res[ti][pi] = result{
+				mu:    mu + phiNew*phiNew*deltaSum,
+				phi:   phiNew,
+				sigma: sigma,
+			}
+		}
+	}
+	for ti, t := range teams {
+		for pi, e := range t {
+			e.Mu = res[ti][pi].mu*glicko2Scale + 1500
+			e.Sigma = res[ti][pi].phi * glicko2Scale
+			e.Volatility = res[ti][pi].sigma
+			e.Elo = int(math.Round(e.Mu))
+		}
+	}
+}
+
+type ratingSystemTrueSkill struct {
+	initial   float64
+	deviation float64
+	beta      float64
+	tau       float64
+	drawProb  float64
+	decay     ratingDecay
+}
+
+func newRatingSystemTrueSkill(p RatingParams) RatingSystem {
+	initial := paramOrDefault(p.Initial, 1500)
+	deviation := paramOrDefault(p.InitialDeviation, initial/3)
+	return &ratingSystemTrueSkill{
+		initial:   initial,
+		deviation: deviation,
+		beta:      paramOrDefault(p.Beta, deviation/2),
+		tau:       paramOrDefault(p.Tau, deviation/100),
+		drawProb:  p.DrawProbability,
+		decay:     newRatingDecay(p, initial),
+	}
+}
+
+func (s *ratingSystemTrueSkill) Decay(e *Elo, now int) {
+	s.decay.decayDeviation(e, now, s.deviation)
+}
+
+func (s *ratingSystemTrueSkill) Reset(e *Elo) {
+	e.Mu = s.initial
+	e.Sigma = s.deviation
+	e.Volatility = 0
+	e.Elo = int(math.Round(e.Mu))
+}
+
+func normPdf(x float64) float64 {
+	return math.Exp(-x*x/2) / math.Sqrt(2*math.Pi)
+}
+
+func normCdf(x float64) float64 {
+	return 0.5 * math.Erfc(-x/math.Sqrt2)
+}
+
+func normPpf(p float64) float64 {
+	return math.Sqrt2 * math.Erfinv(2*p-1)
+}
+
+// trueSkillVW returns additive and multiplicative corrections for
+// difference of performances t with draw margin eps
+func trueSkillVW(t, eps float64, draw bool) (v, w float64) {
+	if !draw {
+		denom := normCdf(t - eps)
+		if denom < 1e-300 {
+			return eps - t, 1
+		}
+		v = normPdf(t-eps) / denom
+		return v, v * (v + t - eps)
+	}
+	denom := normCdf(eps-t) - normCdf(-eps-t)
+	if denom < 1e-300 {
+		return 0, 1
+	}
+	v = (normPdf(-eps-t) - normPdf(eps-t)) / denom
+	w = v*v + ((eps-t)*normPdf(eps-t)+(eps+t)*normPdf(eps+t))/denom
+	return v, w
+}
+
+// Rate with more than two teams is approximated by pairwise updates
+// averaged over all opponents
+func (s *ratingSystemTrueSkill) Rate(teams [][]*Elo, ranks []int, l *RatingLog) {
+	if len(teams) < 2 {
+		l.Skipped = fmt.Sprintf("TrueSkill can not rate %d teams", len(teams))
+		return
+	}
+	for _, t := range teams {
+		for _, e := range t {
+			e.Sigma = math.Sqrt(e.Sigma*e.Sigma + s.tau*s.tau)
+		}
+	}
+	pairs := float64(len(teams) - 1)
+	dmu := make([][]float64, len(teams))
+	sfac := make([][]float64, len(teams))
+	for ti, t := range teams {
+		dmu[ti] = make([]float64, len(t))
+		sfac[ti] = make([]float64, len(t))
+		for pi, e := range t {
+			sfac[ti][pi] = 1
+			l.Teams[ti].Average += e.Mu / float64(len(t))
+		}
+	}
+	for i := range teams {
+		for j := i + 1; j < len(teams); j++ {
+			a, b := i, j
+			if ranks[j] < ranks[i] {
+				a, b = j, i
+			}
+			draw := ranks[a] == ranks[b]
+			n := float64(len(teams[a]) + len(teams[b]))
+			c2 := n * s.beta * s.beta
+			muA, muB := 0.0, 0.0
+			for _, e := range teams[a] {
+				c2 += e.Sigma * e.Sigma
+				muA += e.Mu
+			}
+			for _, e := range teams[b] {
+				c2 += e.Sigma * e.Sigma
+				muB += e.Mu
+			}
+			c := math.Sqrt(c2)
+			eps := 0.0
+			if s.drawProb > 0 {
+				eps = normPpf((s.drawProb+1)/2) * math.Sqrt(n) * s.beta / c
+			}
+			v, w := trueSkillVW((muA-muB)/c, eps, draw)
+			l.Teams[a].Expected += normCdf((muA-muB)/c) / pairs
+			l.Teams[b].Expected += normCdf((muB-muA)/c) / pairs
+			l.Notes = append(l.Notes, fmt.Sprintf("Teams %d and %d c: %.1f v: %.4f w: %.4f", a, b, c, v, w))
+			update := func(ti int, sign float64) {
+				for pi, e := range teams[ti] {
+					s2 := e.Sigma * e.Sigma
+					dmu[ti][pi] += sign * s2 / c * v
+					sfac[ti][pi] *= math.Max(1-s2/c2*w, 0.0001)
+				}
+			}
+			update(a, 1)
+			update(b, -1)
+		}
+	}
+	for ti, t := range teams {
+		for pi, e := range t {
+			e.Mu += dmu[ti][pi] / pairs
+			e.Sigma = math.Sqrt(e.Sigma * e.Sigma * math.Pow(sfac[ti][pi], 1/pairs))
+			e.Elo = int(math.Round(e.Mu))
+		}
+	}
+}
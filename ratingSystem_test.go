@@ -0,0 +1,256 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func testRatingLog(teams int) *RatingLog {
+	return &RatingLog{Teams: make([]RatingLogTeam, teams)}
+}
+
+func testRated(rs RatingSystem, ratings ...float64) []*Elo {
+	ret := []*Elo{}
+	for i, r := range ratings {
+		e := &Elo{Account: i + 1}
+		rs.Reset(e)
+		e.Mu = r
+		e.Elo = int(math.Round(r))
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+func TestRatingSystemElo1v1(t *testing.T) {
+	rs := newRatingSystemElo(RatingParams{})
+	for _, tc := range []struct {
+		name             string
+		winner, loser    float64
+		winDiff, lossDif int
+	}{
+		// k 20, 10 points change hands between equal players
+		{"equal", 1400, 1400, 10, -10},
+		// expected score of 1600 against 1400 is 0.7597, 20*0.2403 = 4.8
+		{"favourite wins", 1600, 1400, 4, -4},
+		{"underdog wins", 1400, 1600, 15, -15},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := testRated(rs, tc.winner, tc.loser)
+			l := testRatingLog(2)
+			rs.Rate([][]*Elo{{p[0]}, {p[1]}}, []int{0, 1}, l)
+			if l.Skipped != "" {
+				t.Fatal(l.Skipped)
+			}
+			if d := p[0].Elo - int(tc.winner); d != tc.winDiff {
+				t.Errorf("winner diff %d, want %d", d, tc.winDiff)
+			}
+			if d := p[1].Elo - int(tc.loser); d != tc.lossDif {
+				t.Errorf("loser diff %d, want %d", d, tc.lossDif)
+			}
+			if e := l.Teams[0].Expected + l.Teams[1].Expected; math.Abs(e-1) > 1e-9 {
+				t.Errorf("expected scores sum to %f", e)
+			}
+		})
+	}
+}
+
+func TestRatingSystemEloSymmetry(t *testing.T) {
+	rs := newRatingSystemElo(RatingParams{K: 32})
+	for _, tc := range []struct {
+		name  string
+		teams [][]float64
+		ranks []int
+	}{
+		{"2v2", [][]float64{{1500, 1300}, {1450, 1420}}, []int{1, 0}},
+		{"3v3", [][]float64{{1200, 1900, 1400}, {1500, 1500, 1500}}, []int{0, 1}},
+		{"ffa", [][]float64{{1400}, {1600}, {1350}, {1700}}, []int{2, 0, 1, 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			teams := [][]*Elo{}
+			sum := 0.0
+			for _, r := range tc.teams {
+				teams = append(teams, testRated(rs, r...))
+				for _, v := range r {
+					sum += v
+				}
+			}
+			rs.Rate(teams, tc.ranks, testRatingLog(len(teams)))
+			after := 0.0
+			for ti, team := range teams {
+				for _, e := range team {
+					after += float64(e.Elo)
+					if e.Mu != float64(e.Elo) {
+						t.Errorf("mu %f does not follow elo %d", e.Mu, e.Elo)
+					}
+				}
+				if ti > 0 && len(team) != len(teams[0]) {
+					t.Fatal("teams must be equal size")
+				}
+			}
+			// truncation of averaged diffs can lose a point per team
+			if d := math.Abs(after - sum); d > float64(len(teams)*len(teams[0])) {
+				t.Errorf("ratings sum changed by %f", d)
+			}
+		})
+	}
+}
+
+func TestRatingSystemSkips(t *testing.T) {
+	for engine, f := range ratingSystems {
+		rs := f(RatingParams{})
+		p := testRated(rs, 1500, 1500)
+		l := testRatingLog(1)
+		rs.Rate([][]*Elo{p}, []int{0}, l)
+		if l.Skipped == "" {
+			t.Errorf("%s rated single team", engine)
+		}
+		for _, e := range p {
+			if e.Mu != 1500 || math.IsNaN(e.Sigma) {
+				t.Errorf("%s changed rating of skipped game: %+v", engine, e)
+			}
+		}
+	}
+	rs := newRatingSystemElo(RatingParams{})
+	l := testRatingLog(2)
+	p := testRated(rs, 1500, 1400)
+	rs.Rate([][]*Elo{{p[0]}, {p[1]}}, []int{0, 0}, l)
+	if l.Skipped != "Elo does not rate draws" || p[0].Elo != 1500 {
+		t.Errorf("elo draw: %q %d", l.Skipped, p[0].Elo)
+	}
+}
+
+// TestRatingSystemGlicko2Reference is the example of Glickman's Glicko-2 paper,
+// each opponent is a separate team of a free for all game
+func TestRatingSystemGlicko2Reference(t *testing.T) {
+	rs := newRatingSystemGlicko2(RatingParams{})
+	p := &Elo{Mu: 1500, Sigma: 200, Volatility: 0.06}
+	o := []*Elo{
+		{Mu: 1400, Sigma: 30, Volatility: 0.06},
+		{Mu: 1550, Sigma: 100, Volatility: 0.06},
+		{Mu: 1700, Sigma: 300, Volatility: 0.06},
+	}
+	l := testRatingLog(4)
+	rs.Rate([][]*Elo{{p}, {o[0]}, {o[1]}, {o[2]}}, []int{1, 2, 0, 0}, l)
+	if l.Skipped != "" {
+		t.Fatal(l.Skipped)
+	}
+	if math.Abs(p.Mu-1464.06) > 0.05 || math.Abs(p.Sigma-151.52) > 0.05 || math.Abs(p.Volatility-0.05999) > 0.00001 {
+		t.Fatalf("got %.2f %.2f %.5f, want 1464.06 151.52 0.05999", p.Mu, p.Sigma, p.Volatility)
+	}
+	if p.Elo != 1464 {
+		t.Fatalf("elo %d does not follow mu", p.Elo)
+	}
+}
+
+func TestRatingSystemGlicko2Symmetry(t *testing.T) {
+	rs := newRatingSystemGlicko2(RatingParams{})
+	p := testRated(rs, 1500, 1500)
+	rs.Rate([][]*Elo{{p[0]}, {p[1]}}, []int{0, 1}, testRatingLog(2))
+	if d := (p[0].Mu - 1500) + (p[1].Mu - 1500); math.Abs(d) > 1e-6 || p[0].Mu <= 1500 {
+		t.Fatalf("equal players moved to %f and %f", p[0].Mu, p[1].Mu)
+	}
+	if math.Abs(p[0].Sigma-p[1].Sigma) > 1e-9 || p[0].Sigma >= 350 {
+		t.Fatalf("deviations %f and %f", p[0].Sigma, p[1].Sigma)
+	}
+}
+
+// TestRatingSystemTrueSkillReference compares to rate_1vs1 of the reference trueskill
+// implementation with default environment (25, 25/3) scaled by 60
+func TestRatingSystemTrueSkillReference(t *testing.T) {
+	rs := newRatingSystemTrueSkill(RatingParams{DrawProbability: 0.1})
+	p := testRated(rs, 1500, 1500)
+	rs.Rate([][]*Elo{{p[0]}, {p[1]}}, []int{0, 1}, testRatingLog(2))
+	for i, want := range [][2]float64{{29.396, 7.171}, {20.604, 7.171}} {
+		if math.Abs(p[i].Mu-want[0]*60) > 0.1 || math.Abs(p[i].Sigma-want[1]*60) > 0.1 {
+			t.Errorf("player %d got %.2f %.2f, want %.2f %.2f", i, p[i].Mu, p[i].Sigma, want[0]*60, want[1]*60)
+		}
+	}
+
+	// draw of equal players only shrinks deviation
+	p = testRated(rs, 1500, 1500)
+	rs.Rate([][]*Elo{{p[0]}, {p[1]}}, []int{0, 0}, testRatingLog(2))
+	if math.Abs(p[0].Mu-1500) > 1e-6 || math.Abs(p[1].Mu-1500) > 1e-6 || math.Abs(p[0].Sigma-6.458*60) > 0.1 {
+		t.Errorf("draw got %.2f %.2f %.2f", p[0].Mu, p[1].Mu, p[0].Sigma)
+	}
+}
+
+func TestRatingSystemDecay(t *testing.T) {
+	const day = 86400
+	params := RatingParams{InactiveDays: 14, DecayPerDay: 2, DecayFloor: 1300, DeviationGrowth: 10}
+	for engine, f := range ratingSystems {
+		t.Run(engine, func(t *testing.T) {
+			rs := f(params)
+			e := testRated(rs, 1500)[0]
+			e.Sigma = 100
+			e.LastPlayed = 1000 * day
+
+			rs.Decay(e, 1000*day+14*day)
+			if e.Mu != 1500 || e.Sigma != 100 || e.TimeDecayed != 0 {
+				t.Fatalf("decayed before inactive days passed: %+v", e)
+			}
+
+			// decay is linear, applying it twice gives the same rating as once
+			rs.Decay(e, 1000*day+19*day)
+			rs.Decay(e, 1000*day+24*day)
+			if e.Elo != 1480 || e.Mu != 1480 {
+				t.Fatalf("after 10 inactive days got %d (%f), want 1480", e.Elo, e.Mu)
+			}
+			if engine != "elo" && math.Abs(e.Sigma-math.Sqrt(100*100+10*10*10)) > 1e-6 {
+				t.Fatalf("deviation %f", e.Sigma)
+			}
+
+			// rating does not go below floor
+			rs.Decay(e, 1000*day+1000*day)
+			if e.Elo != 1300 {
+				t.Fatalf("decayed to %d, floor is 1300", e.Elo)
+			}
+
+			// decay is disabled without inactive days and for players that never played
+			rs = f(RatingParams{DecayPerDay: 2})
+			e = testRated(rs, 1500)[0]
+			e.LastPlayed = day
+			rs.Decay(e, 1000*day)
+			e2 := testRated(f(params), 1500)[0]
+			f(params).Decay(e2, 1000*day)
+			if e.Elo != 1500 || e2.Elo != 1500 {
+				t.Fatalf("decay applied with no inactive days %d or no games %d", e.Elo, e2.Elo)
+			}
+		})
+	}
+}
+
+// TestRatingSystemTeamSizeBonus checks that bigger team is expected to win, elo adds
+// 400*log10(size) to team average and glicko-2 the same ln(size) in its own scale
+func TestRatingSystemTeamSizeBonus(t *testing.T) {
+	rs := newRatingSystemElo(RatingParams{})
+	teams := [][]*Elo{testRated(rs, 1500, 1500), testRated(rs, 1500, 1500, 1500)}
+	l := testRatingLog(2)
+	rs.Rate(teams, []int{0, 1}, l)
+	// effective 1620 against 1691
+	want := 1 / (1 + math.Pow(10, 71.0/400))
+	if math.Abs(l.Teams[0].Expected-want) > 1e-9 || math.Abs(l.Teams[1].Expected-(1-want)) > 1e-9 {
+		t.Fatalf("elo expected %f %f, want %f", l.Teams[0].Expected, l.Teams[1].Expected, want)
+	}
+	// 20*(1-0.3992) = 12.02
+	if teams[0][0].Elo != 1512 || teams[1][0].Elo != 1488 {
+		t.Fatalf("elo after underdog win %d %d", teams[0][0].Elo, teams[1][0].Elo)
+	}
+
+	g := newRatingSystemGlicko2(RatingParams{})
+	teams = [][]*Elo{testRated(g, 1500, 1500), testRated(g, 1500, 1500, 1500)}
+	l = testRatingLog(2)
+	g.Rate(teams, []int{0, 1}, l)
+	phi := 350 / glicko2Scale
+	gphi := glicko2G(phi)
+	want = 1 / (1 + math.Exp(-gphi*(math.Log(2)-math.Log(3))))
+	if math.Abs(l.Teams[0].Expected-want) > 1e-9 || math.Abs(l.Teams[1].Expected-(1-want)) > 1e-9 {
+		t.Fatalf("glicko-2 expected %f %f, want %f", l.Teams[0].Expected, l.Teams[1].Expected, want)
+	}
+	// players use the same bonus as their composite, so both sides agree on who was expected to win
+	if d := (teams[0][0].Mu - 1500) + (teams[1][0].Mu - 1500); math.Abs(d) > 1e-6 {
+		t.Fatalf("glicko-2 changes are not symmetric: %f %f", teams[0][0].Mu, teams[1][0].Mu)
+	}
+	if teams[0][0].Mu <= 1500 {
+		t.Fatalf("underdog did not gain: %f", teams[0][0].Mu)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"github.com/maxsupermanhd/go-wz/wznet"
+)
+
+// replayActivityBucket is game time covered by one point of activity timeline
+const replayActivityBucket = 60000
+
+// ReplayPlayerActivity counts commands of one player:
+// Orders is every droid order packet, UniqueOrders skips orders repeating previous one
+// to the same droids and target (spam clicks and orders resent by the game),
+// SelectionChanges counts orders given to different set of droids than previous one,
+// Builds is build orders (counted in orders too), Research is research start and cancel.
+// APM is (Orders + Research) and EPM is (UniqueOrders + Research) per minute of game time.
+type ReplayPlayerActivity struct {
+	Player           int
+	Position         int
+	Orders           int
+	UniqueOrders     int
+	SelectionChanges int
+	Research         int
+	Builds           int
+	APM              float64
+	EPM              float64
+	TimelineAPM      []int `json:",omitempty"`
+	TimelineEPM      []int `json:",omitempty"`
+}
+
+type ReplayActivity struct {
+	Game       int
+	GameTime   int
+	BucketSize int
+	Players    []ReplayPlayerActivity
+}
+
+// replayOrderTracker remembers last order of each player to tell apart effective commands
+type replayOrderTracker struct {
+	prev map[int]ReplayDroidOrder
+}
+
+func newReplayOrderTracker() *replayOrderTracker {
+	return &replayOrderTracker{prev: map[int]ReplayDroidOrder{}}
+}
+
+// track returns if order is effective and if it was given to other droids than previous one
+func (t *replayOrderTracker) track(o ReplayDroidOrder) (effective bool, selection bool) {
+	p, ok := t.prev[o.Player]
+	t.prev[o.Player] = o
+	selection = !ok || p.DroidsCount != o.DroidsCount || p.DroidsChecksum != o.DroidsChecksum
+	if wznet.DroidOrderSybType(o.SubType) == wznet.DroidOrderSybTypeSec && wznet.DROID_SECONDARY_ORDER(o.SecOrder) == wznet.DSO_RETURN_TO_LOC {
+		return false, selection
+	}
+	effective = selection || p.SubType != o.SubType || p.DroidOrder != o.DroidOrder || p.SecOrder != o.SecOrder ||
+		p.DestID != o.DestID || p.X != o.X || p.Y != o.Y
+	return effective, selection
+}
+
+func calcReplayActivity(ev *ReplayEvents) *ReplayActivity {
+	ret := &ReplayActivity{
+		Game:       ev.Game,
+		GameTime:   ev.GameTimeElapsed,
+		BucketSize: replayActivityBucket,
+		Players:    []ReplayPlayerActivity{},
+	}
+	buckets := ev.GameTimeElapsed/replayActivityBucket + 1
+	players := make([]ReplayPlayerActivity, len(ev.Positions))
+	for i := range players {
+		players[i] = ReplayPlayerActivity{
+			Player:      i,
+			Position:    ev.Positions[i],
+			TimelineAPM: make([]int, buckets),
+			TimelineEPM: make([]int, buckets),
+		}
+	}
+	bucket := func(gt int) int {
+		return min(max(gt/replayActivityBucket, 0), buckets-1)
+	}
+	t := newReplayOrderTracker()
+	for _, o := range ev.DroidOrders {
+		if o.Player < 0 || o.Player >= len(players) {
+			continue
+		}
+		p := &players[o.Player]
+		b := bucket(o.GameTime)
+		effective, selection := t.track(o)
+		p.Orders++
+		p.TimelineAPM[b]++
+		if effective {
+			p.UniqueOrders++
+			p.TimelineEPM[b]++
+		}
+		if selection {
+			p.SelectionChanges++
+		}
+		if o.DroidOrder == int(wznet.DORDER_BUILD) || o.DroidOrder == int(wznet.DORDER_LINEBUILD) {
+			p.Builds++
+		}
+	}
+	for _, r := range ev.Research {
+		if r.Player < 0 || r.Player >= len(players) {
+			continue
+		}
+		p := &players[r.Player]
+		b := bucket(r.GameTime)
+		p.Research++
+		p.TimelineAPM[b]++
+		p.TimelineEPM[b]++
+	}
+	minutes := float64(ev.GameTimeElapsed) / 60000
+	for _, p := range players {
+		// spectators and empty slots never send commands
+		if p.Orders+p.Research == 0 {
+			continue
+		}
+		if minutes > 0 {
+			p.APM = float64(p.Orders+p.Research) / minutes
+			p.EPM = float64(p.UniqueOrders+p.Research) / minutes
+		}
+		ret.Players = append(ret.Players, p)
+	}
+	return ret
+}
+
+func APIgetReplayActivity(_ http.ResponseWriter, r *http.Request) (int, any) {
+	gid, err := strconv.Atoi(mux.Vars(r)["gid"])
+	if err != nil {
+		return 400, nil
+	}
+	ev, err := GetReplayEvents(r.Context(), gid)
+	if err != nil {
+		if errors.Is(err, errReplayNotFound) || errors.Is(err, errReplayIngestFailed) {
+			return 204, nil
+		}
+		return 500, err
+	}
+	return 200, calcReplayActivity(ev)
+}
+
+// PlayerActivity is career average of replay activity, games shorter than
+// activityMinGameMinutes are left out as they are mostly build order
+type PlayerActivity struct {
+	Games            int
+	APM              float64
+	EPM              float64
+	UniqueOrders     float64
+	SelectionChanges float64
+	Research         float64
+	Builds           float64
+}
+
+// GetPlayerActivity averages activity over all identities of account the identity belongs to
+func GetPlayerActivity(ctx context.Context, identID int) (*PlayerActivity, error) {
+	ret := &PlayerActivity{}
+	err := pgxscan.Get(ctx, dbpool, ret, `select count(*) as games, coalesce(avg(a.apm), 0) as apm, coalesce(avg(a.epm), 0) as epm,
+	coalesce(avg(a.unique_orders * 60000.0 / a.game_time), 0) as unique_orders,
+	coalesce(avg(a.selection_changes * 60000.0 / a.game_time), 0) as selection_changes,
+	coalesce(avg(a.research * 60000.0 / a.game_time), 0) as research,
+	coalesce(avg(a.builds * 60000.0 / a.game_time), 0) as builds
+from players as p
+join replay_activity as a on a.game = p.game and a.position = p.position
+where p.identity = any(array(select id from identities where id = $1 or account = (select account from identities where id = $1)))
+	and p.usertype != 'spectator' and a.game_time >= $2`, identID, cfg.GetDInt(5, "activityMinGameMinutes")*60000)
+	return ret, err
+}
+
+func APIgetPlayerActivity(_ http.ResponseWriter, r *http.Request) (int, any) {
+	identSpecifier, err := hex.DecodeString(mux.Vars(r)["identity"])
+	if err != nil {
+		return 400, err
+	}
+	var identID int
+	err = dbpool.QueryRow(r.Context(), `select id from identities where pkey = $1 or hash ^@ encode($1, 'hex') limit 1`, identSpecifier).Scan(&identID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 204, nil
+		}
+		return 500, err
+	}
+	ret, err := GetPlayerActivity(r.Context(), identID)
+	if err != nil {
+		return 500, err
+	}
+	return 200, ret
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestReplayOrderTrackerSelection(t *testing.T) {
+	if replayDroidsChecksum([]uint32{3, 1, 2}) != replayDroidsChecksum([]uint32{1, 2, 3}) {
+		t.Fatal("checksum depends on droid order")
+	}
+	tr := newReplayOrderTracker()
+	o := ReplayDroidOrder{Player: 0, X: 10, Y: 10, DroidsCount: 2, DroidsChecksum: replayDroidsChecksum([]uint32{1, 2})}
+	if effective, selection := tr.track(o); !effective || !selection {
+		t.Fatal("first order must be effective and a selection change")
+	}
+	if effective, selection := tr.track(o); effective || selection {
+		t.Fatal("repeated order must not count")
+	}
+	// same count and target, other droids
+	for i := uint32(3); i < 1000; i++ {
+		o.DroidsChecksum = replayDroidsChecksum([]uint32{i, i + 1})
+		if effective, selection := tr.track(o); !effective || !selection {
+			t.Fatalf("selection of droids %d and %d not told apart", i, i+1)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/maxsupermanhd/go-wz/packet"
+	"github.com/maxsupermanhd/go-wz/replay"
+	"github.com/maxsupermanhd/go-wz/wznet"
+)
+
+// ReplayInfo is what visualisations need from replay settings, slices are indexed by player
+type ReplayInfo struct {
+	Game            int
+	Status          string
+	Error           *string
+	MaxPlayers      int
+	GameTimeElapsed int
+	Positions       []int
+	Colours         []int
+	Events          int
+	TimeIngested    time.Time
+}
+
+type ReplayDroidOrder struct {
+	Seq            int
+	GameTime       int
+	Player         int
+	SubType        int
+	DroidOrder     int
+	SecOrder       int
+	DestID         int64
+	X              int
+	Y              int
+	DroidsCount    int
+	DroidsChecksum int64
+}
+
+type ReplayResearch struct {
+	Seq      int
+	GameTime int
+	Player   int
+	Start    bool
+	Building int64
+	Topic    int64
+}
+
+type ReplayStructureBuild struct {
+	Seq       int
+	GameTime  int
+	Player    int
+	StructRef int64
+	X         int
+	Y         int
+	X2        int
+	Y2        int
+	Direction int
+}
+
+// ReplayEvents are replay packets normalized into rows, game time of event is
+// the last game time packet seen before it
+type ReplayEvents struct {
+	ReplayInfo
+	DroidOrders     []ReplayDroidOrder
+	Research        []ReplayResearch
+	StructureBuilds []ReplayStructureBuild
+}
+
+var errReplayIngestFailed = errors.New("replay could not be parsed")
+
+// replayIngestVersion is bumped when ingestion starts storing more, older rows get ingested again
+const replayIngestVersion = 3
+
+// replayDroidsChecksum tells apart orders given to different droid groups,
+// 64 bit fnv of sorted ids so different selections practically never collide
+func replayDroidsChecksum(droids []uint32) int64 {
+	droids = slices.Clone(droids)
+	slices.Sort(droids)
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, droids)
+	return int64(h.Sum64())
+}
+
+func parseReplayEvents(gid int, rpl *replay.Replay) *ReplayEvents {
+	ret := &ReplayEvents{
+		ReplayInfo: ReplayInfo{
+			Game:            gid,
+			Status:          "done",
+			MaxPlayers:      rpl.Settings.GameOptions.Game.MaxPlayers,
+			GameTimeElapsed: rpl.End.GameTimeElapsed,
+			Positions:       []int{},
+			Colours:         []int{},
+		},
+		DroidOrders:     []ReplayDroidOrder{},
+		Research:        []ReplayResearch{},
+		StructureBuilds: []ReplayStructureBuild{},
+	}
+	for _, p := range rpl.Settings.GameOptions.NetplayPlayers {
+		ret.Positions = append(ret.Positions, p.Position)
+		ret.Colours = append(ret.Colours, p.Colour)
+	}
+	gameTime := 0
+	for seq, m := range rpl.Messages {
+		switch p := m.NetPacket.(type) {
+		case packet.PkGameGameTime:
+			gameTime = int(p.GameTime)
+		case packet.PkGameDroidInfo:
+			ret.DroidOrders = append(ret.DroidOrders, ReplayDroidOrder{
+				Seq:            seq,
+				GameTime:       gameTime,
+				Player:         int(p.Player),
+				SubType:        int(p.SubType),
+				DroidOrder:     int(p.Order),
+				SecOrder:       int(p.SecOrder),
+				DestID:         int64(p.DestID),
+				X:              int(p.CoordX),
+				Y:              int(p.CoordY),
+				DroidsCount:    len(p.Droids),
+				DroidsChecksum: replayDroidsChecksum(p.Droids),
+			})
+			if p.Order == wznet.DORDER_BUILD || p.Order == wznet.DORDER_LINEBUILD {
+				ret.StructureBuilds = append(ret.StructureBuilds, ReplayStructureBuild{
+					Seq:       seq,
+					GameTime:  gameTime,
+					Player:    int(p.Player),
+					StructRef: int64(p.StructRef),
+					X:         int(p.CoordX),
+					Y:         int(p.CoordY),
+					X2:        int(p.CoordX2),
+					Y2:        int(p.CoordY2),
+					Direction: int(p.Direction),
+				})
+			}
+		case packet.PkGameResearchStatus:
+			ret.Research = append(ret.Research, ReplayResearch{
+				Seq:      seq,
+				GameTime: gameTime,
+				Player:   int(p.Player),
+				Start:    p.Start,
+				Building: int64(p.Building),
+				Topic:    int64(p.Topic),
+			})
+		}
+	}
+	ret.Events = len(ret.DroidOrders) + len(ret.Research)
+	return ret
+}
+
+// ingestReplay parses stored replay and replaces its events, games with broken
+// replays are marked failed so they are not retried
+func ingestReplay(ctx context.Context, gid int) (*ReplayEvents, error) {
+	content, err := getReplayFromStorage(ctx, gid)
+	if err != nil {
+		return nil, err
+	}
+	rpl, err := replay.ReadReplay(bytes.NewBuffer(content))
+	if err == nil && rpl == nil {
+		err = errors.New("replay is nil")
+	}
+	if err != nil {
+		_, derr := dbpool.Exec(ctx, `insert into replay_ingest (game, status, error, version) values ($1, 'failed', $2, $3)
+on conflict (game) do update set status = excluded.status, error = excluded.error, version = excluded.version, time_ingested = now()`, gid, err.Error(), replayIngestVersion)
+		if derr != nil {
+			log.Printf("Failed to mark replay of game %d as failed: %s", gid, derr.Error())
+		}
+		return nil, fmt.Errorf("%w: %s", errReplayIngestFailed, err.Error())
+	}
+	ev := parseReplayEvents(gid, rpl)
+	act := calcReplayActivity(ev)
+
+	tx, err := dbpool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	for _, t := range []string{"replay_droid_orders", "replay_research", "replay_structure_builds", "replay_activity"} {
+		_, err = tx.Exec(ctx, `delete from `+t+` where game = $1`, gid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"replay_droid_orders"},
+		[]string{"game", "seq", "game_time", "player", "sub_type", "droid_order", "sec_order", "dest_id", "x", "y", "droids_count", "droids_checksum"},
+		pgx.CopyFromSlice(len(ev.DroidOrders), func(i int) ([]any, error) {
+			o := ev.DroidOrders[i]
+			return []any{gid, o.Seq, o.GameTime, o.Player, o.SubType, o.DroidOrder, o.SecOrder, o.DestID, o.X, o.Y, o.DroidsCount, o.DroidsChecksum}, nil
+		}))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"replay_research"},
+		[]string{"game", "seq", "game_time", "player", "start", "building", "topic"},
+		pgx.CopyFromSlice(len(ev.Research), func(i int) ([]any, error) {
+			r := ev.Research[i]
+			return []any{gid, r.Seq, r.GameTime, r.Player, r.Start, r.Building, r.Topic}, nil
+		}))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"replay_structure_builds"},
+		[]string{"game", "seq", "game_time", "player", "struct_ref", "x", "y", "x2", "y2", "direction"},
+		pgx.CopyFromSlice(len(ev.StructureBuilds), func(i int) ([]any, error) {
+			b := ev.StructureBuilds[i]
+			return []any{gid, b.Seq, b.GameTime, b.Player, b.StructRef, b.X, b.Y, b.X2, b.Y2, b.Direction}, nil
+		}))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"replay_activity"},
+		[]string{"game", "player", "position", "game_time", "orders", "unique_orders", "selection_changes", "research", "builds", "apm", "epm"},
+		pgx.CopyFromSlice(len(act.Players), func(i int) ([]any, error) {
+			a := act.Players[i]
+			return []any{gid, a.Player, a.Position, act.GameTime, a.Orders, a.UniqueOrders, a.SelectionChanges, a.Research, a.Builds, a.APM, a.EPM}, nil
+		}))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `insert into replay_ingest (game, status, max_players, game_time_elapsed, positions, colours, events, version) values ($1, 'done', $2, $3, $4, $5, $6, $7)
+on conflict (game) do update set status = excluded.status, error = null, max_players = excluded.max_players, game_time_elapsed = excluded.game_time_elapsed,
+	positions = excluded.positions, colours = excluded.colours, events = excluded.events, version = excluded.version, time_ingested = now()`,
+		gid, ev.MaxPlayers, ev.GameTimeElapsed, ev.Positions, ev.Colours, ev.Events, replayIngestVersion)
+	if err != nil {
+		return nil, err
+	}
+	return ev, tx.Commit(ctx)
+}
+
+// GetReplayEvents loads parsed replay, replays that were not ingested yet are parsed on the spot
+func GetReplayEvents(ctx context.Context, gid int) (*ReplayEvents, error) {
+	ev := &ReplayEvents{}
+	err := dbpool.QueryRow(ctx, `select game, status, error, max_players, game_time_elapsed, positions, colours, events, time_ingested
+from replay_ingest where game = $1`, gid).Scan(&ev.Game, &ev.Status, &ev.Error, &ev.MaxPlayers, &ev.GameTimeElapsed, &ev.Positions, &ev.Colours, &ev.Events, &ev.TimeIngested)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ingestReplay(ctx, gid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ev.Status != "done" {
+		return nil, errReplayIngestFailed
+	}
+	ev.DroidOrders = []ReplayDroidOrder{}
+	var o ReplayDroidOrder
+	_, err = dbpool.QueryFunc(ctx, `select seq, game_time, player, sub_type, droid_order, sec_order, dest_id, x, y, droids_count, droids_checksum
+from replay_droid_orders where game = $1 order by seq`, []any{gid},
+		[]any{&o.Seq, &o.GameTime, &o.Player, &o.SubType, &o.DroidOrder, &o.SecOrder, &o.DestID, &o.X, &o.Y, &o.DroidsCount, &o.DroidsChecksum},
+		func(_ pgx.QueryFuncRow) error {
+			ev.DroidOrders = append(ev.DroidOrders, o)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	ev.Research = []ReplayResearch{}
+	var rs ReplayResearch
+	_, err = dbpool.QueryFunc(ctx, `select seq, game_time, player, start, building, topic from replay_research where game = $1 order by seq`, []any{gid},
+		[]any{&rs.Seq, &rs.GameTime, &rs.Player, &rs.Start, &rs.Building, &rs.Topic},
+		func(_ pgx.QueryFuncRow) error {
+			ev.Research = append(ev.Research, rs)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	ev.StructureBuilds = []ReplayStructureBuild{}
+	var b ReplayStructureBuild
+	_, err = dbpool.QueryFunc(ctx, `select seq, game_time, player, struct_ref, x, y, x2, y2, direction from replay_structure_builds where game = $1 order by seq`, []any{gid},
+		[]any{&b.Seq, &b.GameTime, &b.Player, &b.StructRef, &b.X, &b.Y, &b.X2, &b.Y2, &b.Direction},
+		func(_ pgx.QueryFuncRow) error {
+			ev.StructureBuilds = append(ev.StructureBuilds, b)
+			return nil
+		})
+	return ev, err
+}
+
+// replayIngestRunner parses replays of finished games in the background, newest first,
+// games ingested by older version are redone too
+func replayIngestRunner() {
+	for {
+		ids := []int{}
+		rows, err := dbpool.Query(context.Background(), `select g.id from games as g
+where g.time_ended is not null and (g.replay is not null or g.replay_stored is not null)
+	and not exists (select 1 from replay_ingest as ri where ri.game = g.id and ri.version >= $1)
+order by g.id desc limit 50`, replayIngestVersion)
+		if err == nil {
+			for rows.Next() {
+				var id int
+				err = rows.Scan(&id)
+				if err != nil {
+					break
+				}
+				ids = append(ids, id)
+			}
+			rows.Close()
+		}
+		if err != nil {
+			log.Printf("Failed to fetch games for replay ingestion: %s", err.Error())
+		}
+		failed := 0
+		for _, id := range ids {
+			_, err := ingestReplay(context.Background(), id)
+			if err != nil {
+				log.Printf("Failed to ingest replay of game %d: %s", id, err.Error())
+				failed++
+			}
+		}
+		// games that keep failing without being marked would be picked up again right away
+		if len(ids) == 0 || failed > 0 {
+			time.Sleep(time.Duration(cfg.GetDInt(5, "replayIngestIntervalMinutes")) * time.Minute)
+		}
+	}
+}
@@ -4,31 +4,90 @@ import (
 	"context"
 	"errors"
 	"log"
+	"sync"
 
-	"github.com/DataDog/zstd"
 	"github.com/jackc/pgx/v4"
+	"github.com/warzone2100/autohoster-frontend/replaystore"
 )
 
 var errReplayNotFound = errors.New("replay not found")
 
+// replayStore is configured with replayStorage.driver, games.replay column
+// still receives new replays until they are moved with cmd/replaymigrate
+var replayStore replaystore.ReplayStore
+
+// replayStores holds backends opened by name from games.replay_stored,
+// replays moved by cmd/replaymigrate may live in backend other than configured one
+var replayStores = struct {
+	sync.Mutex
+	stores map[string]replaystore.ReplayStore
+}{
+	stores: map[string]replaystore.ReplayStore{},
+}
+
+func openReplayStore() error {
+	var err error
+	replayStore, err = replaystore.Open(replaystore.LoadConfig(cfg, ""), dbpool)
+	return err
+}
+
+func getReplayStoreByDriver(driver string) (replaystore.ReplayStore, error) {
+	if driver == replaystore.LoadConfig(cfg, "").Driver {
+		return replayStore, nil
+	}
+	replayStores.Lock()
+	defer replayStores.Unlock()
+	if s, ok := replayStores.stores[driver]; ok {
+		return s, nil
+	}
+	s, err := replaystore.Open(replaystore.LoadConfig(cfg, driver), dbpool)
+	if err != nil {
+		return nil, err
+	}
+	replayStores.stores[driver] = s
+	return s, nil
+}
+
+// getReplayFromStorage reads replay from backend recorded in games.replay_stored,
+// games.replay column is used when it is not set or moved replay is missing
 func getReplayFromStorage(ctx context.Context, gid int) ([]byte, error) {
-	var compressedReplay []byte
-	err := dbpool.QueryRow(ctx, `select replay from games where id = $1`, gid).Scan(&compressedReplay)
-	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
-		log.Printf("Error fetching replay from database: %s", err.Error())
+	var stored *string
+	err := dbpool.QueryRow(ctx, `select replay_stored from games where id = $1`, gid).Scan(&stored)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errReplayNotFound
+	}
+	if err != nil {
+		log.Printf("Error fetching replay %d location: %s", gid, err.Error())
+		return nil, err
+	}
+	stores := []replaystore.ReplayStore{&replaystore.Postgres{DB: dbpool}}
+	if stored != nil && *stored != "postgres" {
+		s, err := getReplayStoreByDriver(*stored)
+		if err != nil {
+			log.Printf("Error opening replay storage %q for game %d: %s", *stored, gid, err.Error())
+			return nil, err
+		}
+		stores = []replaystore.ReplayStore{s, stores[0]}
 	}
-	if len(compressedReplay) > 0 {
-		return zstd.Decompress(nil, compressedReplay)
+	for _, s := range stores {
+		replay, err := s.Get(ctx, gid)
+		if err == nil {
+			return replay, nil
+		}
+		if !errors.Is(err, replaystore.ErrNotFound) {
+			log.Printf("Error fetching replay %d from storage: %s", gid, err.Error())
+			return nil, err
+		}
 	}
 	return nil, errReplayNotFound
 }
 
 func checkReplayExistsInStorage(ctx context.Context, gid int) bool {
-	var replayPresent int
-	err := dbpool.QueryRow(ctx, `select count(replay) from games where id = $1 and replay is not null`, gid).Scan(&replayPresent)
-	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+	var replayPresent bool
+	err := dbpool.QueryRow(ctx, `select replay is not null or replay_stored is not null from games where id = $1`, gid).Scan(&replayPresent)
+	if err != nil {
 		log.Printf("Error fetching replay from database: %s", err.Error())
 		return false
 	}
-	return replayPresent == 1
+	return replayPresent
 }
@@ -0,0 +1,192 @@
+package replaystore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FS is content-addressed directory, objects/<hash> holds compressed replay named
+// by sha256 of uncompressed one and games/<id>/<hash> is hard link to it, identical replays
+// share one object that is removed with its last link
+type FS struct {
+	Dir string
+	// locks serialize linking and unlinking of objects, striped by first byte of hash
+	locks [256]sync.Mutex
+}
+
+const fsReplayExt = ".wzrp.zst"
+
+func NewFS(dir string) (*FS, error) {
+	for _, d := range []string{"objects", "games", "tmp"} {
+		err := os.MkdirAll(filepath.Join(dir, d), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &FS{Dir: dir}, nil
+}
+
+func (s *FS) gameDir(gid int) string {
+	return filepath.Join(s.Dir, "games", strconv.Itoa(gid))
+}
+
+func (s *FS) objectPath(hash string) string {
+	return filepath.Join(s.Dir, "objects", hash[:2], hash+fsReplayExt)
+}
+
+func (s *FS) lock(hash string) *sync.Mutex {
+	b, _ := hex.DecodeString(hash[:2])
+	return &s.locks[b[0]]
+}
+
+// gameLink returns path of game's link and hash of object it points to, ErrNotFound if there is none
+func (s *FS) gameLink(gid int) (string, string, error) {
+	entries, err := os.ReadDir(s.gameDir(gid))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", "", ErrNotFound
+	}
+	if err != nil {
+		return "", "", err
+	}
+	for _, e := range entries {
+		hash, ok := strings.CutSuffix(e.Name(), fsReplayExt)
+		if ok && len(hash) == sha256.Size*2 {
+			return filepath.Join(s.gameDir(gid), e.Name()), hash, nil
+		}
+	}
+	return "", "", ErrNotFound
+}
+
+func (s *FS) Get(_ context.Context, gid int) ([]byte, error) {
+	p, _, err := s.gameLink(gid)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decompress(stored)
+}
+
+func (s *FS) Put(ctx context.Context, gid int, replay []byte) error {
+	sum := sha256.Sum256(replay)
+	hash := hex.EncodeToString(sum[:])
+	_, old, err := s.gameLink(gid)
+	if err == nil && old == hash {
+		return nil
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	err = s.Delete(ctx, gid)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(s.gameDir(gid), 0755)
+	if err != nil {
+		return err
+	}
+	// object must not be removed by Delete of other game between check and link
+	l := s.lock(hash)
+	l.Lock()
+	defer l.Unlock()
+	obj := s.objectPath(hash)
+	if _, err := os.Stat(obj); errors.Is(err, fs.ErrNotExist) {
+		stored, err := compress(replay)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(obj), 0755)
+		if err != nil {
+			return err
+		}
+		tmp, err := os.CreateTemp(filepath.Join(s.Dir, "tmp"), hash)
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(stored)
+		if err == nil {
+			err = tmp.Sync()
+		}
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), obj)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return os.Link(obj, filepath.Join(s.gameDir(gid), hash+fsReplayExt))
+}
+
+func (s *FS) Exists(_ context.Context, gid int) (bool, error) {
+	_, _, err := s.gameLink(gid)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete unlinks game and removes object once no other game links to it
+func (s *FS) Delete(_ context.Context, gid int) error {
+	p, hash, err := s.gameLink(gid)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	l := s.lock(hash)
+	l.Lock()
+	defer l.Unlock()
+	err = os.Remove(p)
+	if err != nil {
+		return err
+	}
+	os.Remove(s.gameDir(gid))
+	obj := s.objectPath(hash)
+	st, err := os.Stat(obj)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok && sys.Nlink == 1 {
+		return os.Remove(obj)
+	}
+	return nil
+}
+
+func (s *FS) Stat(_ context.Context, gid int) (Stat, error) {
+	p, _, err := s.gameLink(gid)
+	if err != nil {
+		return Stat{}, err
+	}
+	st, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Stat{}, ErrNotFound
+	}
+	if err != nil {
+		return Stat{}, err
+	}
+	return Stat{Size: st.Size(), Modified: st.ModTime()}, nil
+}
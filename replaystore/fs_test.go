@@ -0,0 +1,178 @@
+package replaystore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func countObjects(t *testing.T, dir string) int {
+	t.Helper()
+	c := 0
+	err := filepath.Walk(filepath.Join(dir, "objects"), func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			c++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestFSPutGet(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get of missing replay: %v", err)
+	}
+	if _, err := s.Stat(ctx, 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stat of missing replay: %v", err)
+	}
+	if ok, err := s.Exists(ctx, 1); ok || err != nil {
+		t.Fatalf("exists of missing replay: %v %v", ok, err)
+	}
+	if err := s.Delete(ctx, 1); err != nil {
+		t.Fatalf("delete of missing replay: %v", err)
+	}
+
+	replay := bytes.Repeat([]byte("replay data "), 100)
+	if err := s.Put(ctx, 1, replay); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, replay) {
+		t.Fatal("replay read back does not match")
+	}
+	if ok, err := s.Exists(ctx, 1); !ok || err != nil {
+		t.Fatalf("exists: %v %v", ok, err)
+	}
+	st, err := s.Stat(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size <= 0 || st.Size >= int64(len(replay)) {
+		t.Fatalf("stat size %d is not compressed size of %d bytes", st.Size, len(replay))
+	}
+
+	// overwrite with other replay replaces object
+	other := []byte("other replay")
+	if err := s.Put(ctx, 1, other); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Get(ctx, 1); !bytes.Equal(got, other) {
+		t.Fatal("overwritten replay does not match")
+	}
+	if c := countObjects(t, s.Dir); c != 1 {
+		t.Fatalf("%d objects after overwrite, want 1", c)
+	}
+}
+
+func TestFSDedupe(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := []byte("same replay")
+	for _, gid := range []int{1, 2} {
+		if err := s.Put(ctx, gid, replay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put(ctx, 3, []byte("different replay")); err != nil {
+		t.Fatal(err)
+	}
+	if c := countObjects(t, s.Dir); c != 2 {
+		t.Fatalf("%d objects, identical replays must share one", c)
+	}
+	// putting same replay again must not drop the shared object
+	if err := s.Put(ctx, 1, replay); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get(ctx, 2); err != nil || !bytes.Equal(got, replay) {
+		t.Fatalf("game sharing object lost replay: %v", err)
+	}
+	if c := countObjects(t, s.Dir); c != 2 {
+		t.Fatalf("%d objects, shared object removed before its last link", c)
+	}
+	if err := s.Delete(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if c := countObjects(t, s.Dir); c != 1 {
+		t.Fatalf("%d objects, object must be removed with its last link", c)
+	}
+	if _, err := s.Get(ctx, 2); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get of deleted replay: %v", err)
+	}
+}
+
+func TestFSDeleteDoesNotReadReplay(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, 1, []byte("replay")); err != nil {
+		t.Fatal(err)
+	}
+	p, _, err := s.gameLink(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// object is found by link name, not by content
+	if err := os.WriteFile(p, []byte("not zstd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if c := countObjects(t, s.Dir); c != 0 {
+		t.Fatalf("%d objects left after deleting corrupted replay", c)
+	}
+}
+
+func TestFSConcurrentSharedObject(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := []byte("replay shared by games")
+	var wg sync.WaitGroup
+	for gid := 1; gid <= 4; gid++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if err := s.Put(ctx, gid, replay); err != nil {
+					t.Errorf("put %d: %s", gid, err)
+					return
+				}
+				if err := s.Delete(ctx, gid); err != nil {
+					t.Errorf("delete %d: %s", gid, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if c := countObjects(t, s.Dir); c != 0 {
+		t.Fatalf("%d objects left after all games were deleted", c)
+	}
+}
@@ -0,0 +1,77 @@
+package replaystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Postgres keeps replays in games.replay column
+type Postgres struct {
+	DB *pgxpool.Pool
+}
+
+func (s *Postgres) Get(ctx context.Context, gid int) ([]byte, error) {
+	var stored []byte
+	err := s.DB.QueryRow(ctx, `select replay from games where id = $1`, gid).Scan(&stored)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && len(stored) == 0) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decompress(stored)
+}
+
+func (s *Postgres) Put(ctx context.Context, gid int, replay []byte) error {
+	stored, err := compress(replay)
+	if err != nil {
+		return err
+	}
+	tag, err := s.DB.Exec(ctx, `update games set replay = $2 where id = $1`, gid, stored)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("game %d does not exist", gid)
+	}
+	return nil
+}
+
+func (s *Postgres) Exists(ctx context.Context, gid int) (bool, error) {
+	var ret bool
+	err := s.DB.QueryRow(ctx, `select exists(select 1 from games where id = $1 and replay is not null)`, gid).Scan(&ret)
+	return ret, err
+}
+
+func (s *Postgres) Delete(ctx context.Context, gid int) error {
+	_, err := s.DB.Exec(ctx, `update games set replay = null where id = $1`, gid)
+	return err
+}
+
+func (s *Postgres) Stat(ctx context.Context, gid int) (Stat, error) {
+	var ret Stat
+	var size *int64
+	err := s.DB.QueryRow(ctx, `select octet_length(replay), coalesce(time_ended, time_started) from games where id = $1`, gid).Scan(&size, &ret.Modified)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && size == nil) {
+		return ret, ErrNotFound
+	}
+	if size != nil {
+		ret.Size = *size
+	}
+	return ret, err
+}
+
+// MarkStored records which backend holds the replay moved out of games.replay column,
+// driver "postgres" clears the mark
+func MarkStored(ctx context.Context, db *pgxpool.Pool, gid int, driver string) error {
+	var stored *string
+	if driver != "postgres" {
+		stored = &driver
+	}
+	_, err := db.Exec(ctx, `update games set replay_stored = $2 where id = $1`, gid, stored)
+	return err
+}
@@ -0,0 +1,84 @@
+// Package replaystore keeps zstd-compressed game replays in one of several backends.
+package replaystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/DataDog/zstd"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/maxsupermanhd/lac"
+)
+
+var ErrNotFound = errors.New("replay not found")
+
+type Stat struct {
+	// Size is compressed size as stored
+	Size     int64
+	Modified time.Time
+}
+
+// ReplayStore works with uncompressed replays, compression is backend's business
+type ReplayStore interface {
+	Get(ctx context.Context, gid int) ([]byte, error)
+	Put(ctx context.Context, gid int, replay []byte) error
+	Exists(ctx context.Context, gid int) (bool, error)
+	Delete(ctx context.Context, gid int) error
+	Stat(ctx context.Context, gid int) (Stat, error)
+}
+
+type Config struct {
+	Driver string
+	// fs
+	Dir string
+	// s3
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Prefix    string
+}
+
+// LoadConfig reads replayStorage section of config, driver overrides replayStorage.driver when not empty
+func LoadConfig(c *lac.Conf, driver string) Config {
+	if driver == "" {
+		driver = c.GetDSString("postgres", "replayStorage", "driver")
+	}
+	return Config{
+		Driver:    driver,
+		Dir:       c.GetDSString("./replays", "replayStorage", "fs", "dir"),
+		Endpoint:  c.GetDSString("", "replayStorage", "s3", "endpoint"),
+		Bucket:    c.GetDSString("", "replayStorage", "s3", "bucket"),
+		Region:    c.GetDSString("us-east-1", "replayStorage", "s3", "region"),
+		AccessKey: c.GetDSString("", "replayStorage", "s3", "accessKey"),
+		SecretKey: c.GetDSString("", "replayStorage", "s3", "secretKey"),
+		Prefix:    c.GetDSString("replays/", "replayStorage", "s3", "prefix"),
+	}
+}
+
+func Open(c Config, db *pgxpool.Pool) (ReplayStore, error) {
+	switch c.Driver {
+	case "postgres":
+		return &Postgres{DB: db}, nil
+	case "fs":
+		return NewFS(c.Dir)
+	case "s3":
+		if c.Endpoint == "" || c.Bucket == "" {
+			return nil, errors.New("s3 replay storage requires endpoint and bucket")
+		}
+		return &S3{Endpoint: c.Endpoint, Bucket: c.Bucket, Region: c.Region, AccessKey: c.AccessKey, SecretKey: c.SecretKey, Prefix: c.Prefix}, nil
+	default:
+		return nil, fmt.Errorf("unknown replay storage driver %q", c.Driver)
+	}
+}
+
+func compress(replay []byte) ([]byte, error) {
+	return zstd.CompressLevel(nil, replay, zstd.BestCompression)
+}
+
+func decompress(stored []byte) ([]byte, error) {
+	return zstd.Decompress(nil, stored)
+}
@@ -0,0 +1,180 @@
+package replaystore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 keeps replays as <Prefix><id>.wzrp.zst objects in S3 compatible bucket,
+// requests use path-style addressing and signature v4 so MinIO and alike work too
+type S3 struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Prefix    string
+	Client    *http.Client
+}
+
+func (s *S3) key(gid int) string {
+	return s.Prefix + strconv.Itoa(gid) + ".wzrp.zst"
+}
+
+// s3URIEncode escapes everything but unreserved characters as signature v4 requires
+func s3URIEncode(s string, encodeSlash bool) string {
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *S3) do(ctx context.Context, method string, gid int, body []byte) (*http.Response, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u := *endpoint
+	u.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + s.Bucket + "/" + s.key(gid)
+	u.RawPath = strings.TrimSuffix(endpoint.EscapedPath(), "/") + "/" + s3URIEncode(s.Bucket, true) + "/" + s3URIEncode(s.key(gid), false)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadSum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payloadSum[:])
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		"",
+		"host:" + u.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalSum := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+	signingKey := s3HMAC(s3HMAC(s3HMAC(s3HMAC([]byte("AWS4"+s.SecretKey), date), s.Region), "s3"), "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(signingKey, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+
+	cl := s.Client
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+	return cl.Do(req)
+}
+
+func s3Error(method string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s responded %s: %s", method, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (s *S3) Get(ctx context.Context, gid int) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, gid, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("get", resp)
+	}
+	stored, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(stored)
+}
+
+func (s *S3) Put(ctx context.Context, gid int, replay []byte) error {
+	stored, err := compress(replay)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPut, gid, stored)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("put", resp)
+	}
+	return nil
+}
+
+func (s *S3) Exists(ctx context.Context, gid int) (bool, error) {
+	_, err := s.Stat(ctx, gid)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *S3) Delete(ctx context.Context, gid int) error {
+	resp, err := s.do(ctx, http.MethodDelete, gid, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error("delete", resp)
+	}
+	return nil
+}
+
+func (s *S3) Stat(ctx context.Context, gid int) (Stat, error) {
+	resp, err := s.do(ctx, http.MethodHead, gid, nil)
+	if err != nil {
+		return Stat{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return Stat{}, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Stat{}, s3Error("head", resp)
+	}
+	ret := Stat{Size: resp.ContentLength}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		ret.Modified, _ = http.ParseTime(lm)
+	}
+	return ret, nil
+}
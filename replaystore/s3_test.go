@@ -0,0 +1,172 @@
+package replaystore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testS3AccessKey = "AKIDEXAMPLE"
+	testS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testS3Region    = "eu-test-1"
+)
+
+var testS3AuthRegexp = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([a-z0-9;-]+), Signature=([0-9a-f]{64})$`)
+
+func testHMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// testS3Verify recomputes signature v4 of the request as S3 would
+func testS3Verify(r *http.Request, body []byte) error {
+	m := testS3AuthRegexp.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return errors.New("malformed authorization header " + r.Header.Get("Authorization"))
+	}
+	if m[1] != testS3AccessKey || m[3] != testS3Region {
+		return errors.New("wrong credential scope " + m[0])
+	}
+	amzDate := r.Header.Get("x-amz-date")
+	t, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return err
+	}
+	if m[2] != t.Format("20060102") || time.Since(t).Abs() > 15*time.Minute {
+		return errors.New("bad request date " + amzDate)
+	}
+	bodySum := sha256.Sum256(body)
+	if r.Header.Get("x-amz-content-sha256") != hex.EncodeToString(bodySum[:]) {
+		return errors.New("payload hash does not match body")
+	}
+	canonicalHeaders := ""
+	for _, h := range strings.Split(m[4], ";") {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		canonicalHeaders += h + ":" + strings.TrimSpace(v) + "\n"
+	}
+	canonicalRequest := r.Method + "\n" + r.URL.EscapedPath() + "\n" + r.URL.RawQuery + "\n" +
+		canonicalHeaders + "\n" + m[4] + "\n" + r.Header.Get("x-amz-content-sha256")
+	canonicalSum := sha256.Sum256([]byte(canonicalRequest))
+	scope := m[2] + "/" + m[3] + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+	key := testHMAC(testHMAC(testHMAC(testHMAC([]byte("AWS4"+testS3SecretKey), m[2]), m[3]), "s3"), "aws4_request")
+	if hex.EncodeToString(testHMAC(key, stringToSign)) != m[5] {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// testS3Server is in-memory bucket that rejects requests with bad signatures
+func testS3Server(t *testing.T) (*httptest.Server, map[string][]byte) {
+	objects := map[string][]byte{}
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := testS3Verify(r, body); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		p := r.URL.EscapedPath()
+		obj, ok := objects[p]
+		switch r.Method {
+		case http.MethodPut:
+			objects[p] = body
+		case http.MethodGet, http.MethodHead:
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("Content-Length", strconv.Itoa(len(obj)))
+			if r.Method == http.MethodGet {
+				w.Write(obj)
+			}
+		case http.MethodDelete:
+			delete(objects, p)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, objects
+}
+
+func TestS3RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	srv, objects := testS3Server(t)
+	s := &S3{Endpoint: srv.URL + "/storage/", Bucket: "autohoster", Region: testS3Region,
+		AccessKey: testS3AccessKey, SecretKey: testS3SecretKey, Prefix: "replays (test)/", Client: srv.Client()}
+
+	if _, err := s.Get(ctx, 7); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get of missing replay: %v", err)
+	}
+	if ok, err := s.Exists(ctx, 7); ok || err != nil {
+		t.Fatalf("exists of missing replay: %v %v", ok, err)
+	}
+
+	replay := bytes.Repeat([]byte("replay data "), 100)
+	if err := s.Put(ctx, 7, replay); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objects["/storage/autohoster/replays%20%28test%29/7.wzrp.zst"]; !ok {
+		t.Fatalf("object stored under unexpected key, have %v", objects)
+	}
+	got, err := s.Get(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, replay) {
+		t.Fatal("replay read back does not match")
+	}
+	st, err := s.Stat(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size <= 0 || st.Size >= int64(len(replay)) || st.Modified.IsZero() {
+		t.Fatalf("stat %+v", st)
+	}
+	if ok, err := s.Exists(ctx, 7); !ok || err != nil {
+		t.Fatalf("exists: %v %v", ok, err)
+	}
+
+	if err := s.Delete(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, 7); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get of deleted replay: %v", err)
+	}
+}
+
+func TestS3BadCredentials(t *testing.T) {
+	srv, objects := testS3Server(t)
+	s := &S3{Endpoint: srv.URL, Bucket: "autohoster", Region: testS3Region,
+		AccessKey: testS3AccessKey, SecretKey: "wrong", Client: srv.Client()}
+	err := s.Put(context.Background(), 1, []byte("replay"))
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("put with wrong secret: %v", err)
+	}
+	if len(objects) != 0 {
+		t.Fatal("object stored despite bad signature")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/davecgh/go-spew/spew"
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v4"
+	"github.com/warzone2100/autohoster-frontend/store"
 )
 
 func APIgetResearchlogData(_ http.ResponseWriter, r *http.Request) (int, any) {
@@ -41,38 +42,27 @@ func APIgetResearchlogData(_ http.ResponseWriter, r *http.Request) (int, any) {
 
 func APIgetResearchSummary(w http.ResponseWriter, r *http.Request) (int, any) {
 	params := mux.Vars(r)
-	gid := params["gid"]
+	gid, err := strconv.Atoi(params["gid"])
+	if err != nil {
+		return 400, nil
+	}
 	var researchLog []resEntry
-	var players []Player
 	var settingAlliance int
-	err := dbpool.QueryRow(context.Background(), `SELECT
-	coalesce(research_log, '[]')::jsonb,
-	json_agg(json_build_object(
-		'Position', p.position,
-		'Name', i.name,
-		'Team', p.team,
-		'Usertype', p.usertype,
-		'Color', p.color,
-		'Identity', i.id,
-		'IdentityPubKey', encode(i.pkey, 'hex'),
-		'Account', a.id,
-		'DisplayName', coalesce(i.name, a.display_name),
-		'Rating', (select r from rating as r where r.category = g.display_category and r.account = i.account),
-		'Props', p.props
-	))::jsonb,
-	setting_alliance
-FROM games as g
-JOIN players as p on g.id = p.game
-JOIN identities as i on p.identity = i.id
-LEFT JOIN accounts as a on a.id = i.account
-WHERE g.id = $1
-GROUP BY 1, 3`, gid).Scan(&researchLog, &players, &settingAlliance)
+	err = dbpool.QueryRow(r.Context(), `SELECT coalesce(research_log, '[]')::jsonb, setting_alliance FROM games WHERE id = $1`, gid).Scan(&researchLog, &settingAlliance)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return http.StatusNoContent, nil
 		}
 		return 500, err
 	}
+	gamePlayers, err := store.GetGamePlayers(r.Context(), dbpool, gid)
+	if err != nil {
+		return 500, err
+	}
+	players := gamePlayers[gid]
+	if len(players) == 0 {
+		return http.StatusNoContent, nil
+	}
 
 	isShared := settingAlliance == 2
 
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type RatingArchiveEntry struct {
+	Category    int
+	Account     int
+	Rank        int
+	DisplayName string
+	Elo         int
+	Played      int
+	Won         int
+	Lost        int
+	TimePlayed  int
+}
+
+// seedEloStates puts accounts into starting state of the category,
+// soft reset seeds from previous season take priority over initial rating
+func seedEloStates(ctx context.Context, db pgxscan.Querier, category int, accounts []int, states map[int]*Elo, rs RatingSystem) error {
+	for _, acc := range accounts {
+		e, ok := states[acc]
+		if !ok {
+			e = &Elo{Account: acc}
+			states[acc] = e
+		}
+		rs.Reset(e)
+	}
+	rows, err := db.Query(ctx, `select account, elo, mu, sigma, volatility from rating_seed where category = $1 and account = any($2)`, category, accounts)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var acc, elo int
+		var mu, sigma, volatility float64
+		err = rows.Scan(&acc, &elo, &mu, &sigma, &volatility)
+		if err != nil {
+			return err
+		}
+		e := states[acc]
+		e.Elo, e.Mu, e.Sigma, e.Volatility = elo, mu, sigma, volatility
+	}
+	return rows.Err()
+}
+
+func GetRatingArchiveTop(ctx context.Context, db *pgxpool.Pool, category int, limit int) ([]*RatingArchiveEntry, error) {
+	r := []*RatingArchiveEntry{}
+	return r, pgxscan.Select(ctx, db, &r, `SELECT * FROM rating_archive WHERE category = $1 ORDER BY rank LIMIT $2`, category, limit)
+}
+
+// seasonRunner archives categories that ended and starts their successors
+func seasonRunner() {
+	for {
+		if ratingWriteLock.TryLock() {
+			err := seasonRolloverAll(context.Background())
+			ratingWriteLock.Unlock()
+			if err != nil {
+				log.Printf("Failed to roll over seasons: %s", err.Error())
+			}
+		}
+		time.Sleep(time.Duration(cfg.GetDInt(10, "seasonCheckIntervalMinutes")) * time.Minute)
+	}
+}
+
+func seasonRolloverAll(ctx context.Context) error {
+	cats := []*RatingCategory{}
+	err := pgxscan.Select(ctx, dbpool, &cats, `SELECT * FROM rating_categories WHERE archived = false AND time_ends < now() ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	for _, c := range cats {
+		successor, err := seasonRollover(ctx, c)
+		if err != nil {
+			return fmt.Errorf("category %d: %w", c.ID, err)
+		}
+		ratingLookupCacheClear()
+		msg := fmt.Sprintf("Rating category `%d` (%s) ended and was archived", c.ID, c.Name)
+		if successor != 0 {
+			msg += fmt.Sprintf(", successor category `%d` created", successor)
+		}
+		log.Println(msg)
+		err = modSendWebhook(msg)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+var seasonNameRegexp = regexp.MustCompile(`^(.*) season ([0-9]+)$`)
+
+func seasonNextName(name string) string {
+	m := seasonNameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return name + " season 2"
+	}
+	n, _ := strconv.Atoi(m[2])
+	return m[1] + " season " + strconv.Itoa(n+1)
+}
+
+// seasonCurrent follows successors of category to the one that is not archived yet,
+// returns pgx.ErrNoRows when season chain ended without successor
+func seasonCurrent(ctx context.Context, category int) (int, error) {
+	var id int
+	err := dbpool.QueryRow(ctx, `with recursive chain as (
+	select id, archived from rating_categories where id = $1
+	union all
+	select c.id, c.archived from rating_categories as c join chain on c.predecessor = chain.id
+)
+select id from chain where archived = false order by id desc limit 1`, category).Scan(&id)
+	return id, err
+}
+
+// seasonRollover freezes final standings of category and creates successor
+// if season length is configured, returns id of successor or 0
+func seasonRollover(ctx context.Context, c *RatingCategory) (int, error) {
+	tx, err := dbpool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `insert into rating_archive (category, account, rank, display_name, elo, played, won, lost, time_played)
+select r.category, r.account, rank() over (order by r.elo desc), coalesce(a.display_name, ''), r.elo, r.played, r.won, r.lost, r.time_played
+from rating as r
+join accounts as a on a.id = r.account
+where r.category = $1 and r.played > 0
+on conflict do nothing`, c.ID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, `update rating_categories set archived = true where id = $1`, c.ID)
+	if err != nil {
+		return 0, err
+	}
+	successor := 0
+	if c.Params.SeasonDays > 0 && c.TimeEnds != nil && *c.TimeEnds != nil {
+		starts := **c.TimeEnds
+		ends := starts.Add(time.Duration(c.Params.SeasonDays * float64(24*time.Hour)))
+		err = tx.QueryRow(ctx, `insert into rating_categories (time_starts, time_ends, name, engine, params, predecessor)
+values ($1, $2, $3, $4, $5, $6) returning id`, starts, ends, seasonNextName(c.Name), c.Engine, c.Params, c.ID).Scan(&successor)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(ctx, `insert into map_whitelist (hash, category, name, players, note, balance, balanced, added_by, time_added)
+select hash, $2, name, players, note, balance, balanced, added_by, time_added from map_whitelist where category = $1`, c.ID, successor)
+		if err != nil {
+			return 0, err
+		}
+		if c.Params.CarryOver > 0 {
+			err = seasonSeed(ctx, tx, c, successor)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return successor, tx.Commit(ctx)
+}
+
+// seasonSeed moves final ratings of category towards initial ones and stores them as successor seeds
+func seasonSeed(ctx context.Context, tx pgx.Tx, c *RatingCategory, successor int) error {
+	rs, err := NewRatingSystem(c)
+	if err != nil {
+		return err
+	}
+	carry := math.Min(c.Params.CarryOver, 1)
+	b := pgx.Batch{}
+	var e Elo
+	_, err = tx.QueryFunc(ctx, `select account, elo, mu, sigma, volatility from rating where category = $1 and played > 0`, []any{c.ID},
+		[]any{&e.Account, &e.Elo, &e.Mu, &e.Sigma, &e.Volatility},
+		func(_ pgx.QueryFuncRow) error {
+			f := Elo{Account: e.Account}
+			rs.Reset(&f)
+			f.Elo += int(math.Round(float64(e.Elo-f.Elo) * carry))
+			f.Mu += (e.Mu - f.Mu) * carry
+			f.Sigma += (e.Sigma - f.Sigma) * carry
+			f.Volatility += (e.Volatility - f.Volatility) * carry
+			b.Queue(`insert into rating_seed (category, account, elo, mu, sigma, volatility) values ($1, $2, $3, $4, $5, $6)`,
+				successor, f.Account, f.Elo, f.Mu, f.Sigma, f.Volatility)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	br := tx.SendBatch(ctx, &b)
+	for i := 0; i < b.Len(); i++ {
+		_, err = br.Exec()
+		if err != nil {
+			br.Close()
+			return err
+		}
+	}
+	return br.Close()
+}
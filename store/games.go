@@ -0,0 +1,251 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+type PlayerRating struct {
+	Elo        int
+	Played     int
+	Won        int
+	Lost       int
+	TimePlayed int
+	Account    int
+	Category   int
+}
+
+type Player struct {
+	Position       int
+	Name           string
+	Team           int
+	Color          int
+	Identity       int
+	IdentityPubKey string
+	Usertype       string
+	Rating         *PlayerRating
+	Account        int
+	DisplayName    string
+	Props          map[string]any
+}
+
+type Game struct {
+	ID              int
+	Version         string
+	Instance        int
+	TimeStarted     time.Time
+	TimeEnded       *time.Time
+	GameTime        *int
+	SettingScavs    int
+	SettingAlliance int
+	SettingPower    int
+	SettingBase     int
+	MapName         string
+	MapHash         string
+	Mods            string
+	Deleted         bool
+	Hidden          bool
+	Calculated      bool
+	DebugTriggered  bool
+	Players         []Player
+	ReplayFound     bool
+	DisplayCategory int
+	// SortValue is ListGamesParams.SortValue of the game, used to continue listing after it
+	SortValue *string `json:"-"`
+}
+
+// GameFilter accumulates conditions on games table (aliased g),
+// values are only ever passed as query arguments
+type GameFilter struct {
+	Conds []string
+	Args  []any
+}
+
+// Arg registers value and returns its placeholder
+func (f *GameFilter) Arg(v any) string {
+	f.Args = append(f.Args, v)
+	return "$" + strconv.Itoa(len(f.Args))
+}
+
+func (f *GameFilter) Where() string {
+	if len(f.Conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(f.Conds, " AND ")
+}
+
+type ListGamesParams struct {
+	Filter GameFilter
+	// OrderBy is sql order expression on g, it is applied after search relevance
+	OrderBy string
+	// Search orders games by best similarity of participant names first
+	Search string
+	Limit  int
+	Offset int
+	// SortValue is sql expression on g selected as text into Game.SortValue
+	SortValue string
+	// PlayerProps includes per player game statistics which are big
+	PlayerProps bool
+}
+
+const gameColumns = `g.id, g.version, g.instance, g.time_started, g.time_ended, g.game_time,
+	g.setting_scavs, g.setting_alliance, g.setting_power, g.setting_base,
+	g.map_name, g.map_hash, g.mods, g.deleted, g.hidden, g.calculated, g.debug_triggered,
+	g.display_category`
+
+func scanGames(rows pgx.Rows, sortValue bool) ([]*Game, error) {
+	defer rows.Close()
+	ret := []*Game{}
+	for rows.Next() {
+		g := &Game{Players: []Player{}}
+		dest := []any{&g.ID, &g.Version, &g.Instance, &g.TimeStarted, &g.TimeEnded, &g.GameTime,
+			&g.SettingScavs, &g.SettingAlliance, &g.SettingPower, &g.SettingBase,
+			&g.MapName, &g.MapHash, &g.Mods, &g.Deleted, &g.Hidden, &g.Calculated, &g.DebugTriggered,
+			&g.DisplayCategory}
+		if sortValue {
+			dest = append(dest, &g.SortValue)
+		}
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, g)
+	}
+	return ret, rows.Err()
+}
+
+// ListGames returns games matching filter with players filled in
+func ListGames(ctx context.Context, db Querier, p ListGamesParams) ([]*Game, error) {
+	f := p.Filter
+	f.Args = append([]any{}, f.Args...)
+	order := p.OrderBy
+	if order == "" {
+		order = "g.id desc"
+	}
+	if p.Search != "" {
+		order = `(select max(similarity(coalesce(si.name, sa.display_name), ` + f.Arg(p.Search) + `::text))
+	from players as sp
+	join identities as si on si.id = sp.identity
+	left join accounts as sa on sa.id = si.account
+	where sp.game = g.id) desc nulls last, ` + order
+	}
+	columns := gameColumns
+	if p.SortValue != "" {
+		columns += ", (" + p.SortValue + ")::text"
+	}
+	req := `select ` + columns + ` from games as g ` + f.Where() + ` order by ` + order
+	if p.Limit > 0 {
+		req += " limit " + strconv.Itoa(p.Limit)
+	}
+	if p.Offset > 0 {
+		req += " offset " + strconv.Itoa(p.Offset)
+	}
+	rows, err := db.Query(ctx, req, f.Args...)
+	if err != nil {
+		return nil, err
+	}
+	games, err := scanGames(rows, p.SortValue != "")
+	if err != nil {
+		return nil, err
+	}
+	return games, fillPlayers(ctx, db, games, p.PlayerProps)
+}
+
+func getGame(ctx context.Context, db Querier, cond string, arg any) (*Game, error) {
+	rows, err := db.Query(ctx, `select `+gameColumns+` from games as g where `+cond, arg)
+	if err != nil {
+		return nil, err
+	}
+	games, err := scanGames(rows, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(games) == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	return games[0], fillPlayers(ctx, db, games[:1], true)
+}
+
+// GetGame returns game with players, pgx.ErrNoRows if there is no such game
+func GetGame(ctx context.Context, db Querier, id int) (*Game, error) {
+	return getGame(ctx, db, "g.id = $1", id)
+}
+
+// GetGameStartedAt looks game up by its start time that is used in public links
+func GetGameStartedAt(ctx context.Context, db Querier, t time.Time) (*Game, error) {
+	return getGame(ctx, db, "g.time_started = $1", t)
+}
+
+// GetGamePlayers returns players of games ordered by position, rating is
+// the one of game's display category
+func GetGamePlayers(ctx context.Context, db Querier, games ...int) (map[int][]Player, error) {
+	return getGamePlayers(ctx, db, true, games)
+}
+
+func getGamePlayers(ctx context.Context, db Querier, props bool, games []int) (map[int][]Player, error) {
+	rows, err := db.Query(ctx, `select p.game, p.position, coalesce(i.name, ''), p.team, p.color, i.id, encode(i.pkey, 'hex'), p.usertype,
+	coalesce(a.id, 0), coalesce(i.name, a.display_name, ''), case when $2 then p.props end,
+	r.account, coalesce(r.elo, 0), coalesce(r.played, 0), coalesce(r.won, 0), coalesce(r.lost, 0), coalesce(r.time_played, 0), coalesce(r.category, 0)
+from players as p
+join games as g on g.id = p.game
+join identities as i on i.id = p.identity
+left join accounts as a on a.id = i.account
+left join rating as r on r.category = g.display_category and r.account = i.account
+where p.game = any($1)
+order by p.game, p.position`, games, props)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := map[int][]Player{}
+	for rows.Next() {
+		var gid int
+		var p Player
+		var props []byte
+		var ratingAccount *int
+		var rt PlayerRating
+		err = rows.Scan(&gid, &p.Position, &p.Name, &p.Team, &p.Color, &p.Identity, &p.IdentityPubKey, &p.Usertype,
+			&p.Account, &p.DisplayName, &props,
+			&ratingAccount, &rt.Elo, &rt.Played, &rt.Won, &rt.Lost, &rt.TimePlayed, &rt.Category)
+		if err != nil {
+			return nil, err
+		}
+		if len(props) > 0 {
+			err = json.Unmarshal(props, &p.Props)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if ratingAccount != nil {
+			rt.Account = *ratingAccount
+			p.Rating = &rt
+		}
+		ret[gid] = append(ret[gid], p)
+	}
+	return ret, rows.Err()
+}
+
+func fillPlayers(ctx context.Context, db Querier, games []*Game, props bool) error {
+	if len(games) == 0 {
+		return nil
+	}
+	ids := make([]int, len(games))
+	for i, g := range games {
+		ids[i] = g.ID
+	}
+	players, err := getGamePlayers(ctx, db, props, ids)
+	if err != nil {
+		return err
+	}
+	for _, g := range games {
+		if p, ok := players[g.ID]; ok {
+			g.Players = p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testSchema is minimal subset of frontend schema that store queries touch
+const testSchema = `
+create table accounts (
+	id int primary key,
+	username text not null,
+	display_name text
+);
+create table identities (
+	id int primary key,
+	name text,
+	pkey bytea not null,
+	hash text not null,
+	account int references accounts(id)
+);
+create table games (
+	id int primary key,
+	version text not null default 'master',
+	instance int not null default 0,
+	time_started timestamp not null,
+	time_ended timestamp,
+	game_time int,
+	setting_scavs int not null default 0,
+	setting_alliance int not null default 2,
+	setting_power int not null default 0,
+	setting_base int not null default 0,
+	map_name text not null,
+	map_hash text not null default '',
+	mods text not null default '',
+	deleted boolean not null default false,
+	hidden boolean not null default false,
+	calculated boolean not null default true,
+	debug_triggered boolean not null default false,
+	display_category int not null default 0
+);
+create table players (
+	game int not null references games(id),
+	position int not null,
+	identity int not null references identities(id),
+	team int not null,
+	color int not null default 0,
+	usertype text not null,
+	props jsonb,
+	primary key (game, position)
+);
+create table rating (
+	category int not null,
+	account int not null references accounts(id),
+	elo int not null,
+	played int not null default 0,
+	won int not null default 0,
+	lost int not null default 0,
+	time_played int not null default 0,
+	primary key (category, account)
+);`
+
+const testData = `
+insert into accounts (id, username, display_name) values (1, 'alice', 'Alice'), (2, 'bob', 'Bob');
+insert into identities (id, name, pkey, hash, account) values
+	(10, 'alice', '\x0a', 'aa', 1),
+	(20, 'bob', '\x0b', 'bb', 2),
+	(30, 'guest', '\x0c', 'cc', null);
+insert into games (id, time_started, map_name, display_category, hidden) values
+	(1, '2024-01-01 10:00', 'Sk-Rush', 1, false),
+	(2, '2024-01-02 10:00', 'Sk-Startup', 1, false),
+	(3, '2024-01-03 10:00', 'Sk-Rush', 2, false),
+	(4, '2024-01-04 10:00', 'Sk-Rush', 1, true);
+insert into players (game, position, identity, team, usertype, props) values
+	(1, 1, 20, 1, 'loser', '{"kills": 3}'),
+	(1, 0, 10, 0, 'winner', '{"kills": 5}'),
+	(1, 2, 30, 0, 'winner', null),
+	(2, 0, 20, 0, 'winner', null),
+	(3, 0, 10, 0, 'loser', null),
+	(4, 0, 10, 0, 'winner', null);
+insert into rating (category, account, elo, played, won, lost) values
+	(1, 1, 1600, 10, 7, 3),
+	(1, 2, 1400, 10, 3, 7),
+	(2, 2, 1800, 1, 1, 0);`
+
+// testDB connects to AUTOHOSTER_TEST_DSN and builds fixtures in a throwaway schema
+func testDB(t *testing.T) *pgxpool.Pool {
+	dsn := os.Getenv("AUTOHOSTER_TEST_DSN")
+	if dsn == "" {
+		t.Skip("AUTOHOSTER_TEST_DSN is not set")
+	}
+	ctx := context.Background()
+	schema := fmt.Sprintf("store_test_%d_%d", os.Getpid(), time.Now().UnixNano())
+	admin, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close(ctx)
+	_, err = admin.Exec(ctx, `create schema `+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn, err := pgx.Connect(context.Background(), dsn)
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		defer conn.Close(context.Background())
+		_, err = conn.Exec(context.Background(), `drop schema `+schema+` cascade`)
+		if err != nil {
+			t.Log(err)
+		}
+	})
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema
+	db, err := pgxpool.ConnectConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	for _, q := range []string{testSchema, testData} {
+		_, err = db.Exec(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestGameFilterArg(t *testing.T) {
+	f := GameFilter{}
+	if w := f.Where(); w != "" {
+		t.Fatalf("empty filter where %q", w)
+	}
+	f.Conds = append(f.Conds, "g.map_name = "+f.Arg("Sk-Rush"))
+	f.Conds = append(f.Conds, "g.hidden = "+f.Arg(false))
+	f.Conds = append(f.Conds, "g.id = any("+f.Arg([]int{1, 2})+")")
+	want := "WHERE g.map_name = $1 AND g.hidden = $2 AND g.id = any($3)"
+	if w := f.Where(); w != want {
+		t.Fatalf("where %q, want %q", w, want)
+	}
+	if len(f.Args) != 3 || f.Args[0] != "Sk-Rush" || f.Args[1] != false {
+		t.Fatalf("args %#v", f.Args)
+	}
+}
+
+func TestListGamesFilter(t *testing.T) {
+	db := testDB(t)
+	f := GameFilter{}
+	f.Conds = append(f.Conds, "g.map_name = "+f.Arg("Sk-Rush"), "g.hidden = "+f.Arg(false))
+	p := ListGamesParams{Filter: f, OrderBy: "g.id asc"}
+	games, err := ListGames(context.Background(), db, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 2 || games[0].ID != 1 || games[1].ID != 3 {
+		t.Fatalf("got games %v", gameIDs(games))
+	}
+	// args of caller's filter are not appended to by listing
+	if len(p.Filter.Args) != 2 {
+		t.Fatalf("filter args changed: %#v", p.Filter.Args)
+	}
+
+	p.Limit, p.Offset = 1, 1
+	games, err = ListGames(context.Background(), db, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 1 || games[0].ID != 3 {
+		t.Fatalf("got games %v with limit and offset", gameIDs(games))
+	}
+	if games[0].SortValue != nil {
+		t.Fatalf("sort value %q selected without being asked for", *games[0].SortValue)
+	}
+
+	// sort value of the returned row continues keyset pagination
+	p.SortValue = "g.time_started"
+	games, err = ListGames(context.Background(), db, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 1 || games[0].SortValue == nil || *games[0].SortValue != "2024-01-03 10:00:00" {
+		t.Fatalf("sort value %v", games[0].SortValue)
+	}
+}
+
+func TestGetGamePlayers(t *testing.T) {
+	db := testDB(t)
+	g, err := GetGame(context.Background(), db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Players) != 3 {
+		t.Fatalf("got %d players", len(g.Players))
+	}
+	for i, p := range g.Players {
+		if p.Position != i {
+			t.Fatalf("player %d has position %d, players must be ordered by position", i, p.Position)
+		}
+	}
+	alice, bob, guest := g.Players[0], g.Players[1], g.Players[2]
+	if alice.Rating == nil || alice.Rating.Elo != 1600 || alice.Rating.Category != 1 || alice.Rating.Account != 1 {
+		t.Fatalf("alice rating %+v", alice.Rating)
+	}
+	if bob.Rating == nil || bob.Rating.Elo != 1400 {
+		t.Fatalf("bob rating %+v", bob.Rating)
+	}
+	if guest.Rating != nil || guest.Account != 0 {
+		t.Fatalf("guest without account has rating %+v account %d", guest.Rating, guest.Account)
+	}
+	if alice.Props["kills"] != float64(5) {
+		t.Fatalf("alice props %#v", alice.Props)
+	}
+
+	// rating comes from display category of the game only
+	players, err := GetGamePlayers(context.Background(), db, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := players[2][0].Rating; r == nil || r.Elo != 1400 || r.Category != 1 {
+		t.Fatalf("bob rating in game 2 %+v", r)
+	}
+	if r := players[3][0].Rating; r != nil {
+		t.Fatalf("alice is not rated in category 2 but got %+v", r)
+	}
+}
+
+func TestGetGameNotFound(t *testing.T) {
+	db := testDB(t)
+	_, err := GetGame(context.Background(), db, 1000)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("got %v, want pgx.ErrNoRows", err)
+	}
+	_, err = GetGameStartedAt(context.Background(), db, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	if !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("got %v, want pgx.ErrNoRows", err)
+	}
+}
+
+func gameIDs(games []*Game) []int {
+	ret := []int{}
+	for _, g := range games {
+		ret = append(ret, g.ID)
+	}
+	return ret
+}
@@ -0,0 +1,7 @@
+// Package store holds typed queries shared by handlers so schema details live in one place.
+package store
+
+import "github.com/georgysavva/scany/pgxscan"
+
+// Querier is satisfied by pool, connection and transaction
+type Querier = pgxscan.Querier
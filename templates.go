@@ -171,6 +171,7 @@ var layoutFuncs = template.FuncMap{
 	},
 	"GameTimeToString":  GameTimeToString,
 	"GameTimeToStringI": GameTimeToStringI,
+	"SecondsToString":   SecondsToString,
 	"GameDirToWeek":     GameDirToWeek,
 	"InstanceIDToWeek":  InstanceIDToWeek,
 	"strcut": func(str string, num int) string { // https://play.golang.org/p/EzvhWMljku
@@ -48,3 +48,12 @@ func WSLobbyUpdateLobby(lobby map[string]any) {
 		"data": lobby,
 	}
 }
+
+// WSRatingRecalcProgress sends a copy, clients marshal it later while runner keeps updating the job
+func WSRatingRecalcProgress(j *RatingRecalcJob) {
+	jc := *j
+	RatingWSHub.bcast <- map[string]any{
+		"type": "RatingRecalcProgress",
+		"data": jc,
+	}
+}